@@ -0,0 +1,145 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/auth"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/handler"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// authMethodsUsed returns the authentication methods used by default or by any of the routes.
+func authMethodsUsed(defaultMethods []auth.Method, routes []handler.Route) map[auth.Method]bool {
+	used := map[auth.Method]bool{}
+	for _, m := range defaultMethods {
+		used[m] = true
+	}
+	for _, r := range routes {
+		for _, m := range r.Auth {
+			used[m] = true
+		}
+	}
+	delete(used, auth.MethodNone)
+	return used
+}
+
+// newAuthenticators creates authenticators of the used methods according to the flags.
+func newAuthenticators(used map[auth.Method]bool) (map[auth.Method]auth.Authenticator, error) {
+	var err error
+	authenticators := map[auth.Method]auth.Authenticator{}
+	if used[auth.MethodStaticToken] {
+		if authTokenFile == "" {
+			return nil, fmt.Errorf("the %v authentication requires the --auth-token-file flag", auth.MethodStaticToken)
+		}
+		if authenticators[auth.MethodStaticToken], err = auth.NewTokenFileAuthenticator(authTokenFile); err != nil {
+			return nil, fmt.Errorf("failed to load token file: %w", err)
+		}
+	}
+	if used[auth.MethodBasic] {
+		if authHtpasswdFile == "" {
+			return nil, fmt.Errorf("the %v authentication requires the --auth-htpasswd-file flag", auth.MethodBasic)
+		}
+		if authenticators[auth.MethodBasic], err = auth.NewHtpasswdAuthenticator(authHtpasswdFile, authCacheTTL); err != nil {
+			return nil, fmt.Errorf("failed to load htpasswd file: %w", err)
+		}
+	}
+	if used[auth.MethodTokenReview] {
+		clientset, err := localClientset()
+		if err != nil {
+			return nil, err
+		}
+		authenticators[auth.MethodTokenReview] = auth.NewTokenReviewAuthenticator(clientset, authTokenReviewAudiences, authCacheTTL)
+	}
+	return authenticators, nil
+}
+
+// newAuthorizer creates the authorizer of the authenticated users according to the flags, nil if the authorization is disabled.
+func newAuthorizer() (auth.Authorizer, error) {
+	if authzResource == "" {
+		return nil, nil
+	}
+	if authzVerb == "" {
+		return nil, fmt.Errorf("the authorization requires the --authz-verb flag")
+	}
+	clientset, err := localClientset()
+	if err != nil {
+		return nil, err
+	}
+	attributes := auth.ResourceAttributes{Verb: authzVerb, Group: authzGroup, Resource: authzResource, Subresource: authzSubresource}
+	return auth.NewSubjectAccessReviewAuthorizer(clientset, attributes, authCacheTTL), nil
+}
+
+// authzObjects returns the objects of the default targets the users have to be authorized to access,
+// the service in each of the watched namespaces or all objects in them if there is no service.
+func authzObjects() []auth.Object {
+	var objects []auth.Object
+	for _, namespace := range watchedNamespaces() {
+		objects = append(objects, auth.Object{Namespace: namespace, Name: serviceName})
+	}
+	return objects
+}
+
+// newBackendCredentials creates the credentials sent to the targets according to the flags, nil if none are set.
+func newBackendCredentials() (auth.Credentials, error) {
+	set := 0
+	for _, isSet := range []bool{backendTokenFile != "", backendServiceAccountToken, backendBasicAuthUser != ""} {
+		if isSet {
+			set++
+		}
+	}
+	if set > 1 {
+		return nil, fmt.Errorf("only one of the --backend-token-file, --backend-service-account-token and --backend-basic-auth-user flags can be set")
+	}
+	switch {
+	case backendTokenFile != "":
+		return auth.NewTokenFileCredentials(backendTokenFile, backendCredentialsRefresh)
+	case backendServiceAccountToken:
+		return auth.NewTokenFileCredentials(auth.ServiceAccountTokenFile, backendCredentialsRefresh)
+	case backendBasicAuthUser != "":
+		if backendBasicAuthPasswordFile == "" {
+			return nil, fmt.Errorf("the --backend-basic-auth-user flag requires the --backend-basic-auth-password-file flag")
+		}
+		return auth.NewBasicCredentials(backendBasicAuthUser, backendBasicAuthPasswordFile, backendCredentialsRefresh)
+	}
+	return nil, nil
+}
+
+// localClientset returns client of the cluster the broadcaster authenticates and authorizes the requests against.
+func localClientset() (kubernetes.Interface, error) {
+	config, err := localKubeconfig()
+	if err != nil {
+		return nil, err
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	return clientset, nil
+}
+
+// localKubeconfig returns the kubeconfig of the cluster the broadcaster authenticates the requests against,
+// the first one of the --kube-context flags if set.
+func localKubeconfig() (*rest.Config, error) {
+	if len(kubeconfigs) == 0 {
+		if err := loadKubeconfigs(); err != nil {
+			return nil, err
+		}
+	}
+	if len(kubeContexts) > 0 {
+		return kubeconfigs[kubeContexts[0]], nil
+	}
+	return kubeconfigs[""], nil
+}
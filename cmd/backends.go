@@ -0,0 +1,377 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/auth"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/handler"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"sort"
+	"sync"
+)
+
+// backendsHandler is the part of the handler configured by the watched resources.
+type backendsHandler interface {
+	// SetRoutes sets the routes, they take precedence over the static ones from the configuration.
+	SetRoutes(routes []handler.Route)
+	SetBackendTargets(backend string, targets []controller.Target)
+	RemoveBackend(backend string)
+}
+
+// backendSpec is route of the requests to backend together with the discovery of its targets.
+type backendSpec struct {
+	// backend is unique name of the backend, its discovery is restarted only if the name changes.
+	backend       string
+	route         handler.Route
+	newDiscoverer func() (controller.Discoverer, error)
+	// onUpdate is optionally called with every update of the backend targets and on every reconcile with the last one.
+	onUpdate func(update controller.Update)
+}
+
+// backendDiscovery is running discovery of targets of single backend.
+type backendDiscovery struct {
+	discoverer controller.Discoverer
+	onUpdate   func(update controller.Update)
+	last       controller.Update
+	mtx        sync.Mutex
+	done       chan struct{}
+	stopped    chan struct{}
+}
+
+// report sets the callback of the backend spec and calls it with the last update of the targets.
+func (b *backendDiscovery) report(onUpdate func(update controller.Update)) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.onUpdate = onUpdate
+	if b.onUpdate != nil {
+		b.onUpdate(b.last)
+	}
+}
+
+// stop stops the discovery and waits until its last update is applied.
+func (b *backendDiscovery) stop() {
+	close(b.done)
+	b.discoverer.Stop()
+	<-b.stopped
+}
+
+// dynamicBackends reconciles the backends from the watched resources into routes of the handler
+// and keeps discovery of targets running for each of them. The backends are updated by sources,
+// e.g. annotated services per cluster and namespace.
+type dynamicBackends struct {
+	handler     backendsHandler
+	routes      map[string][]handler.Route
+	discoveries map[string]map[string]*backendDiscovery
+	stoppers    []func()
+	mtx         sync.Mutex
+	// The flags are copied since they may be changed by reload of the config.
+	includeNotReady, includeTerminating, resolveZones, routesCrossNamespace bool
+}
+
+func newDynamicBackends(h backendsHandler) *dynamicBackends {
+	return &dynamicBackends{
+		handler:              h,
+		routes:               map[string][]handler.Route{},
+		discoveries:          map[string]map[string]*backendDiscovery{},
+		includeNotReady:      includeNotReady,
+		includeTerminating:   includeTerminating,
+		resolveZones:         resolveZones,
+		routesCrossNamespace: routesCrossNamespace,
+	}
+}
+
+// watchedNamespaces returns the namespaces to watch, empty string stands for all of them.
+func watchedNamespaces() []string {
+	if len(namespaces) == 0 {
+		return []string{""}
+	}
+	return namespaces
+}
+
+// watchServices starts watching the annotated services in all the clusters and namespaces.
+func (d *dynamicBackends) watchServices() {
+	for cluster, config := range kubeconfigs {
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			log.Fatalf("Failed to create client of cluster %q: %v", cluster, err)
+		}
+		for _, namespace := range watchedNamespaces() {
+			namespace := namespace
+			watcher, err := controller.NewServicesController(clientset, cluster, &namespace)
+			if err != nil {
+				log.Fatalf("Failed to initialize watching of services: %v", err)
+			}
+			source := fmt.Sprintf("services|%s/%s", cluster, namespace)
+			updatesChannel := make(chan []controller.BroadcastService, 10)
+			go func() {
+				for services := range updatesChannel {
+					var specs []backendSpec
+					for _, svc := range services {
+						svc := svc
+						// Sources may overlap so the backend is unique per source.
+						backend := source + "|" + svc.Key()
+						route, err := handler.ServiceRoute(svc, backend)
+						if err != nil {
+							log.Errorf("Skipping service %v/%v with invalid annotations: %v", svc.Namespace, svc.Name, err)
+							continue
+						}
+						specs = append(specs, backendSpec{
+							backend: backend,
+							route:   route,
+							newDiscoverer: func() (controller.Discoverer, error) {
+								return controller.NewEndpointController(clientset, svc.Cluster, &svc.Namespace, svc.Name, svc.Port, d.includeNotReady, d.includeTerminating, d.resolveZones)
+							},
+						})
+					}
+					d.update(source, specs)
+				}
+			}()
+			if err := watcher.Start(updatesChannel); err != nil {
+				log.Fatalf("Failed to start watching of services: %v", err)
+			}
+			d.stoppers = append(d.stoppers, watcher.Stop)
+		}
+	}
+}
+
+// watchBroadcastRoutes starts watching the BroadcastRoute resources in all the clusters and namespaces,
+// their status is updated with the number of found targets and the last error.
+func (d *dynamicBackends) watchBroadcastRoutes() {
+	for cluster, config := range kubeconfigs {
+		cluster := cluster
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			log.Fatalf("Failed to create client of cluster %q: %v", cluster, err)
+		}
+		client, err := dynamic.NewForConfig(config)
+		if err != nil {
+			log.Fatalf("Failed to create dynamic client of cluster %q: %v", cluster, err)
+		}
+		for _, namespace := range watchedNamespaces() {
+			namespace := namespace
+			watcher, err := controller.NewBroadcastRoutesController(client, &namespace)
+			if err != nil {
+				log.Fatalf("Failed to initialize watching of BroadcastRoutes: %v", err)
+			}
+			source := fmt.Sprintf("broadcastroutes|%s/%s", cluster, namespace)
+			updatesChannel := make(chan []controller.BroadcastRoute, 10)
+			go func() {
+				for routes := range updatesChannel {
+					var specs []backendSpec
+					for _, r := range routes {
+						r := r
+						setStatus := func(targets int, err error) {
+							statusErr := watcher.UpdateStatus(r.Namespace, r.Name, func(status *controller.BroadcastRouteStatus) {
+								setBroadcastRouteStatus(status, targets, err)
+							})
+							if statusErr != nil {
+								log.Errorf("Failed to update status of BroadcastRoute %v/%v: %v", r.Namespace, r.Name, statusErr)
+							}
+						}
+						backend := source + "|" + r.Key()
+						route, err := handler.RouteFromSpec(r.Spec, backend)
+						if err == nil {
+							err = checkBroadcastRouteNamespaces(r, d.routesCrossNamespace)
+						}
+						if err != nil {
+							log.Errorf("Skipping invalid BroadcastRoute %v/%v: %v", r.Namespace, r.Name, err)
+							setStatus(0, err)
+							continue
+						}
+						for _, s := range r.Spec.Services {
+							route.Objects = append(route.Objects, auth.Object{Namespace: broadcastRouteServiceNamespace(r, s), Name: s.Name})
+						}
+						specs = append(specs, backendSpec{
+							backend: backend,
+							route:   route,
+							newDiscoverer: func() (controller.Discoverer, error) {
+								var discoverers []controller.Discoverer
+								for _, s := range r.Spec.Services {
+									serviceNamespace := broadcastRouteServiceNamespace(r, s)
+									discoverer, err := controller.NewEndpointController(clientset, cluster, &serviceNamespace, s.Name, r.Spec.Port, d.includeNotReady, d.includeTerminating, d.resolveZones)
+									if err != nil {
+										return nil, err
+									}
+									discoverers = append(discoverers, discoverer)
+								}
+								if len(discoverers) == 1 {
+									return discoverers[0], nil
+								}
+								return controller.NewCompositeDiscoverer(discoverers...), nil
+							},
+							onUpdate: func(update controller.Update) {
+								setStatus(len(update.Targets), update.Err)
+							},
+						})
+					}
+					d.update(source, specs)
+				}
+			}()
+			if err := watcher.Start(updatesChannel); err != nil {
+				log.Fatalf("Failed to start watching of BroadcastRoutes: %v", err)
+			}
+			d.stoppers = append(d.stoppers, watcher.Stop)
+		}
+	}
+}
+
+// broadcastRouteServiceNamespace returns namespace of the service of the BroadcastRoute, the namespace of the route by default.
+func broadcastRouteServiceNamespace(r controller.BroadcastRoute, s controller.BroadcastRouteService) string {
+	if s.Namespace == "" {
+		return r.Namespace
+	}
+	return s.Namespace
+}
+
+// checkBroadcastRouteNamespaces returns error if services of the route are in other namespace than the route
+// unless it is allowed, so the route can not expose services the users creating it can not access.
+func checkBroadcastRouteNamespaces(r controller.BroadcastRoute, crossNamespace bool) error {
+	if crossNamespace {
+		return nil
+	}
+	for _, s := range r.Spec.Services {
+		if namespace := broadcastRouteServiceNamespace(r, s); namespace != r.Namespace {
+			return fmt.Errorf("service %v/%v is not in namespace of the route, this requires the --broadcast-routes-cross-namespace flag", namespace, s.Name)
+		}
+	}
+	return nil
+}
+
+// setBroadcastRouteStatus sets the status according to the number of targets and the last error.
+func setBroadcastRouteStatus(status *controller.BroadcastRouteStatus, targets int, err error) {
+	status.Targets = targets
+	reconciled := controller.BroadcastRouteCondition{Type: controller.ConditionReconciled, Status: "True", Reason: "Reconciled"}
+	status.LastError = ""
+	if err != nil {
+		status.LastError = err.Error()
+		reconciled = controller.BroadcastRouteCondition{Type: controller.ConditionReconciled, Status: "False", Reason: "Error", Message: err.Error()}
+	}
+	status.SetCondition(reconciled)
+	found := controller.BroadcastRouteCondition{Type: controller.ConditionTargetsFound, Status: "True", Reason: "TargetsFound", Message: fmt.Sprintf("found %d targets", targets)}
+	if targets == 0 {
+		found = controller.BroadcastRouteCondition{Type: controller.ConditionTargetsFound, Status: "False", Reason: "NoTargets", Message: "no targets found"}
+	}
+	status.SetCondition(found)
+}
+
+// update replaces the backends of the source, starts discovery of the new ones and stops it for the removed ones.
+func (d *dynamicBackends) update(source string, specs []backendSpec) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.discoveries[source] == nil {
+		d.discoveries[source] = map[string]*backendDiscovery{}
+	}
+	discoveries := d.discoveries[source]
+	var routes []handler.Route
+	current := map[string]bool{}
+	for _, spec := range specs {
+		current[spec.backend] = true
+		routes = append(routes, spec.route)
+		discovery, ok := discoveries[spec.backend]
+		if !ok {
+			log.Infof("Starting discovery of targets of backend %v", spec.backend)
+			var err error
+			discovery, err = d.startDiscovery(spec)
+			if err != nil {
+				log.Errorf("Failed to start discovery of targets of backend %v: %v", spec.backend, err)
+				if spec.onUpdate != nil {
+					spec.onUpdate(controller.Update{Err: err})
+				}
+				continue
+			}
+			discoveries[spec.backend] = discovery
+		}
+		// The spec may have changed even if its targets did not.
+		discovery.report(spec.onUpdate)
+	}
+	for backend, discovery := range discoveries {
+		if !current[backend] {
+			log.Infof("Stopping discovery of targets of removed backend %v", backend)
+			// The discovery could set the targets again if it was not stopped before the removal.
+			discovery.stop()
+			delete(discoveries, backend)
+			d.handler.RemoveBackend(backend)
+		}
+	}
+	sortRoutes(routes)
+	d.routes[source] = routes
+	d.handler.SetRoutes(d.allRoutes())
+}
+
+// allRoutes returns routes of all the sources in stable order.
+func (d *dynamicBackends) allRoutes() []handler.Route {
+	var sources []string
+	for source := range d.routes {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	var routes []handler.Route
+	for _, source := range sources {
+		routes = append(routes, d.routes[source]...)
+	}
+	return routes
+}
+
+func (d *dynamicBackends) startDiscovery(spec backendSpec) (*backendDiscovery, error) {
+	discoverer, err := spec.newDiscoverer()
+	if err != nil {
+		return nil, err
+	}
+	updatesChannel := make(chan controller.Update, 10)
+	if err := discoverer.Start(updatesChannel); err != nil {
+		return nil, err
+	}
+	discovery := &backendDiscovery{discoverer: discoverer, done: make(chan struct{}), stopped: make(chan struct{})}
+	go func() {
+		defer close(discovery.stopped)
+		for {
+			select {
+			case <-discovery.done:
+				return
+			case update := <-updatesChannel:
+				if update.Err != nil {
+					log.Errorf("Failed to discover some targets of backend %v: %v", spec.backend, update.Err)
+				}
+				log.Infof("Updating targets of backend %v with new addresses: %v", spec.backend, controller.Addresses(update.Targets))
+				d.handler.SetBackendTargets(spec.backend, update.Targets)
+				discovery.mtx.Lock()
+				discovery.last = update
+				if discovery.onUpdate != nil {
+					discovery.onUpdate(update)
+				}
+				discovery.mtx.Unlock()
+			}
+		}
+	}()
+	return discovery, nil
+}
+
+// stop stops watching of the resources and discovery of all the backends.
+func (d *dynamicBackends) stop() {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for _, stop := range d.stoppers {
+		stop()
+	}
+	for _, discoveries := range d.discoveries {
+		for _, discovery := range discoveries {
+			discovery.stop()
+		}
+	}
+	d.discoveries = map[string]map[string]*backendDiscovery{}
+}
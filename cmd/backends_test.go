@@ -0,0 +1,159 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/handler"
+	"github.com/magiconair/properties/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingBackendsHandler struct {
+	events []string
+	routes []handler.Route
+	mtx    sync.Mutex
+}
+
+func (r *recordingBackendsHandler) SetRoutes(routes []handler.Route) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.routes = routes
+}
+
+func (r *recordingBackendsHandler) SetBackendTargets(backend string, targets []controller.Target) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.events = append(r.events, fmt.Sprintf("set %v %v", backend, controller.Addresses(targets)))
+}
+
+func (r *recordingBackendsHandler) RemoveBackend(backend string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.events = append(r.events, "remove "+backend)
+}
+
+func (r *recordingBackendsHandler) recorded() []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return append([]string{}, r.events...)
+}
+
+type stubDiscoverer struct {
+	updates chan<- controller.Update
+	stopped bool
+}
+
+func (s *stubDiscoverer) Start(updatesChannel chan<- controller.Update) error {
+	s.updates = updatesChannel
+	return nil
+}
+
+func (s *stubDiscoverer) Stop() {
+	s.stopped = true
+}
+
+// statusRecorder collects the updates the backend reported.
+type statusRecorder struct {
+	updates chan controller.Update
+}
+
+func (s *statusRecorder) onUpdate(update controller.Update) {
+	s.updates <- update
+}
+
+func (s *statusRecorder) next(t *testing.T) controller.Update {
+	select {
+	case update := <-s.updates:
+		return update
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update reported")
+	}
+	return controller.Update{}
+}
+
+func TestDynamicBackends_Update(t *testing.T) {
+	h := &recordingBackendsHandler{}
+	d := newDynamicBackends(h)
+	discoverer := &stubDiscoverer{}
+	status := &statusRecorder{updates: make(chan controller.Update, 10)}
+	specs := []backendSpec{
+		{
+			backend:       "pushgateway",
+			route:         handler.Route{PathPrefix: "/metrics", Backend: "pushgateway"},
+			newDiscoverer: func() (controller.Discoverer, error) { return discoverer, nil },
+			onUpdate:      status.onUpdate,
+		},
+		{
+			backend: "pushgateway-job",
+			route:   handler.Route{PathPrefix: "/metrics/job", Backend: "pushgateway-job"},
+			newDiscoverer: func() (controller.Discoverer, error) {
+				return nil, fmt.Errorf("invalid port")
+			},
+		},
+	}
+
+	d.update("routes", specs)
+	assert.Equal(t, status.next(t), controller.Update{})
+	assert.Equal(t, h.routes, []handler.Route{specs[1].route, specs[0].route}, "more specific route first")
+
+	discoverer.updates <- controller.Update{Targets: []controller.Target{{Address: "10.0.0.1:9091"}}}
+	assert.Equal(t, len(status.next(t).Targets), 1)
+
+	// The status is reported on every reconcile even if the targets did not change.
+	d.update("routes", specs)
+	assert.Equal(t, len(status.next(t).Targets), 1)
+
+	d.update("routes", nil)
+	assert.Equal(t, discoverer.stopped, true)
+	assert.Equal(t, h.recorded(), []string{"set pushgateway [10.0.0.1:9091]", "remove pushgateway"})
+	assert.Equal(t, len(h.routes), 0)
+}
+
+func TestSetBroadcastRouteStatus(t *testing.T) {
+	var status controller.BroadcastRouteStatus
+	setBroadcastRouteStatus(&status, 2, nil)
+	assert.Equal(t, status.Targets, 2)
+	assert.Equal(t, status.LastError, "")
+	assert.Equal(t, conditionStatuses(status), map[string]string{controller.ConditionReconciled: "True", controller.ConditionTargetsFound: "True"})
+
+	setBroadcastRouteStatus(&status, 0, fmt.Errorf("port http not found"))
+	assert.Equal(t, status.Targets, 0)
+	assert.Equal(t, status.LastError, "port http not found")
+	assert.Equal(t, conditionStatuses(status), map[string]string{controller.ConditionReconciled: "False", controller.ConditionTargetsFound: "False"})
+	assert.Equal(t, status.Conditions[0].Message, "port http not found")
+}
+
+func conditionStatuses(status controller.BroadcastRouteStatus) map[string]string {
+	statuses := map[string]string{}
+	for _, c := range status.Conditions {
+		statuses[c.Type] = c.Status
+	}
+	return statuses
+}
+
+func TestCheckBroadcastRouteNamespaces(t *testing.T) {
+	r := controller.BroadcastRoute{}
+	r.Namespace = "monitoring"
+	r.Spec.Services = []controller.BroadcastRouteService{{Name: "pushgateway"}, {Name: "pushgateway", Namespace: "monitoring"}}
+	assert.Equal(t, checkBroadcastRouteNamespaces(r, false), nil)
+
+	r.Spec.Services = append(r.Spec.Services, controller.BroadcastRouteService{Name: "pushgateway", Namespace: "monitoring-backup"})
+	err := checkBroadcastRouteNamespaces(r, false)
+	assert.Equal(t, err.Error(), "service monitoring-backup/pushgateway is not in namespace of the route, this requires the --broadcast-routes-cross-namespace flag")
+	assert.Equal(t, checkBroadcastRouteNamespaces(r, true), nil)
+}
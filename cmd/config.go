@@ -0,0 +1,328 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/handler"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"io/ioutil"
+	"os"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// envPrefix is prefix of the environment variables setting the flags.
+	envPrefix = "BROADCAST_"
+	// serviceAccountNamespaceFile contains namespace of the pod when running in the cluster.
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// restartRequiredFlags can not be changed by reload of the configuration since they affect the discovery or listeners.
+var restartRequiredFlags = []string{
+	"interface", "metrics-interface", "keepalive", "kubeconfig", "kube-context", "namespace",
+	"service", "selector", "port", "port-name", "targets", "targets-file", "targets-file-refresh", "dns-name", "dns-srv", "dns-refresh",
+	"include-not-ready", "include-terminating", "resolve-zones", "watch-services", "watch-broadcast-routes", "broadcast-routes-cross-namespace", "config", "config-refresh",
+}
+
+var (
+	configLastReloadSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "broadcaster_config_last_reload_success",
+			Help: "Whether the last reload of the config file was successful.",
+		},
+	)
+
+	// configRules are the rules from the config file evaluated before the --rules-file.
+	configRules []handler.RuleConfig
+	// cliFlags are the flags set on the command line, these take precedence over the environment variables.
+	cliFlags = map[string]bool{}
+	// envFlags are the flags set by the environment variables, these take precedence over the config file.
+	envFlags = map[string]bool{}
+	// flagDefaults are the default values of the flags used if they are removed from the config file.
+	flagDefaults = map[string][]string{}
+	// configFlags are the flags set from the config file.
+	configFlags = map[string]bool{}
+
+	configModTime time.Time
+	configSize    int64
+)
+
+func init() {
+	prometheus.MustRegister(configLastReloadSuccess)
+}
+
+// recordFlags remembers the flags set on command line and the defaults of all the flags.
+func recordFlags(flags *pflag.FlagSet) {
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Changed {
+			cliFlags[f.Name] = true
+		}
+		flagDefaults[f.Name] = flagValue(f)
+	})
+}
+
+// flagEnvName returns name of the environment variable setting the flag, e.g. BROADCAST_SUCCESS_POLICY.
+func flagEnvName(name string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// applyEnv sets the flags not set on the command line from the environment variables, values of the list flags are comma separated.
+// Values of the repeatable flags such as --route may contain commas, so they are separated by new lines instead.
+func applyEnv(flags *pflag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if err != nil || cliFlags[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(flagEnvName(f.Name))
+		if !ok {
+			return
+		}
+		var setErr error
+		if s, ok := f.Value.(pflag.SliceValue); ok && f.Value.Type() == "stringArray" {
+			setErr = s.Replace(envLines(value))
+		} else {
+			setErr = f.Value.Set(value)
+		}
+		if setErr != nil {
+			err = fmt.Errorf("invalid value %v of %v: %w", value, flagEnvName(f.Name), setErr)
+			return
+		}
+		envFlags[f.Name] = true
+	})
+	return err
+}
+
+// envLines returns the non empty lines of the environment variable value.
+func envLines(value string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(value, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// isFlagSet returns true if the flag was set on the command line, by environment variable or in the config file.
+func isFlagSet(name string) bool {
+	return cliFlags[name] || envFlags[name] || configFlags[name]
+}
+
+// defaultNamespace sets the namespace to the one of the pod if running in the cluster and it is not set explicitly.
+func defaultNamespace() {
+	if isFlagSet("namespace") || kubeconfigPath != "" || len(kubeContexts) > 0 {
+		return
+	}
+	content, err := ioutil.ReadFile(serviceAccountNamespaceFile)
+	if err != nil {
+		return
+	}
+	if namespace := strings.TrimSpace(string(content)); namespace != "" {
+		log.Infof("Using namespace %v of the pod", namespace)
+		namespaces = []string{namespace}
+	}
+}
+
+func flagValue(f *pflag.Flag) []string {
+	if s, ok := f.Value.(pflag.SliceValue); ok {
+		return s.GetSlice()
+	}
+	return []string{f.Value.String()}
+}
+
+func setFlag(f *pflag.Flag, values []string) error {
+	if s, ok := f.Value.(pflag.SliceValue); ok {
+		return s.Replace(values)
+	}
+	if len(values) != 1 {
+		return fmt.Errorf("expected single value, got %d", len(values))
+	}
+	return f.Value.Set(values[0])
+}
+
+// readConfigFile returns values of the flags and the rules from the config file.
+// The keys of the file are names of the flags and `rules` in the same format as in the --rules-file.
+func readConfigFile(flags *pflag.FlagSet, path string) (map[string][]string, []handler.RuleConfig, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config file %v: %w", path, err)
+	}
+	values := map[string][]string{}
+	var rules []handler.RuleConfig
+	for key, value := range raw {
+		if key == "rules" {
+			encoded, err := json.Marshal(value)
+			if err != nil {
+				return nil, nil, err
+			}
+			decoder := json.NewDecoder(bytes.NewReader(encoded))
+			decoder.DisallowUnknownFields()
+			if err := decoder.Decode(&rules); err != nil {
+				return nil, nil, fmt.Errorf("invalid rules in config file %v: %w", path, err)
+			}
+			continue
+		}
+		if f := flags.Lookup(key); f == nil || key == "config" {
+			return nil, nil, fmt.Errorf("unknown option %v in config file %v", key, path)
+		}
+		switch v := value.(type) {
+		case nil:
+		case []interface{}:
+			values[key] = []string{}
+			for _, item := range v {
+				values[key] = append(values[key], configValue(item))
+			}
+		default:
+			values[key] = []string{configValue(v)}
+		}
+	}
+	return values, rules, nil
+}
+
+func configValue(value interface{}) string {
+	if number, ok := value.(float64); ok {
+		return strconv.FormatFloat(number, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// applyConfig sets the flags not set on the command line nor by environment variables to values from the config file.
+// Flags removed from the config file since the last time are reset to their defaults.
+func applyConfig(flags *pflag.FlagSet, values map[string][]string, rules []handler.RuleConfig) error {
+	var err error
+	applied := map[string]bool{}
+	flags.VisitAll(func(f *pflag.Flag) {
+		if err != nil || cliFlags[f.Name] || envFlags[f.Name] {
+			return
+		}
+		value, ok := values[f.Name]
+		if !ok {
+			if !configFlags[f.Name] {
+				return
+			}
+			value = flagDefaults[f.Name]
+		}
+		if setErr := setFlag(f, value); setErr != nil {
+			err = fmt.Errorf("invalid value %v of %v: %w", value, f.Name, setErr)
+		}
+		applied[f.Name] = ok
+	})
+	if err != nil {
+		return err
+	}
+	for name, fromConfig := range applied {
+		if fromConfig {
+			configFlags[name] = true
+		} else {
+			delete(configFlags, name)
+		}
+	}
+	configRules = rules
+	return nil
+}
+
+// loadConfig applies the config file if set.
+func loadConfig(flags *pflag.FlagSet) error {
+	if configFile == "" {
+		return nil
+	}
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return err
+	}
+	values, rules, err := readConfigFile(flags, configFile)
+	if err != nil {
+		return err
+	}
+	if err := applyConfig(flags, values, rules); err != nil {
+		return fmt.Errorf("invalid config file %v: %w", configFile, err)
+	}
+	configModTime, configSize = info.ModTime(), info.Size()
+	return nil
+}
+
+// configChanged returns true if the config file was modified since it was loaded.
+func configChanged() bool {
+	info, err := os.Stat(configFile)
+	if err != nil {
+		log.Errorf("Failed to check the config file: %v", err)
+		return false
+	}
+	return !info.ModTime().Equal(configModTime) || info.Size() != configSize
+}
+
+// reloadConfig loads the config file and swaps the handler with new one configured accordingly.
+// If the config is invalid, the previous one is kept. Changes of the restartRequiredFlags are ignored.
+// The targets and routes are carried over to the new handler, but the state of the rate limiters,
+// the in-flight requests counts, the circuit breakers and the authentication caches starts from scratch.
+func reloadConfig(flags *pflag.FlagSet, h *reloadableHandler) error {
+	snapshot := map[string][]string{}
+	flags.VisitAll(func(f *pflag.Flag) {
+		snapshot[f.Name] = flagValue(f)
+	})
+	previousRules, previousConfigFlags := configRules, map[string]bool{}
+	for name := range configFlags {
+		previousConfigFlags[name] = true
+	}
+	restore := func(names []string) {
+		for _, name := range names {
+			if f := flags.Lookup(name); f != nil {
+				_ = setFlag(f, snapshot[name])
+			}
+		}
+	}
+	err := loadConfig(flags)
+	var chain *handlerChain
+	var lvl log.Level
+	if err == nil {
+		for _, name := range restartRequiredFlags {
+			if f := flags.Lookup(name); f != nil && fmt.Sprint(flagValue(f)) != fmt.Sprint(snapshot[name]) {
+				log.Warnf("Change of the %v option requires restart, keeping the previous value", name)
+			}
+		}
+		// The new handler has to be created with the values the process was started with.
+		restore(restartRequiredFlags)
+		chain, err = newHandlerChain()
+	}
+	if err == nil {
+		lvl, err = log.ParseLevel(logLevel)
+	}
+	if err != nil {
+		var names []string
+		for name := range snapshot {
+			names = append(names, name)
+		}
+		restore(names)
+		configRules, configFlags = previousRules, previousConfigFlags
+		configLastReloadSuccess.Set(0)
+		return err
+	}
+	log.SetLevel(lvl)
+	h.swap(chain)
+	configLastReloadSuccess.Set(1)
+	return nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"github.com/magiconair/properties/assert"
+	"github.com/spf13/pflag"
+	"io/ioutil"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig_RestartRequiredFlags(t *testing.T) {
+	var (
+		reviewed    []string
+		reviewedMtx sync.Mutex
+	)
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var review authorizationv1.SubjectAccessReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reviewedMtx.Lock()
+		reviewed = append(reviewed, review.Spec.ResourceAttributes.Namespace+"/"+review.Spec.ResourceAttributes.Name)
+		reviewedMtx.Unlock()
+		review.APIVersion, review.Kind = "authorization.k8s.io/v1", "SubjectAccessReview"
+		review.Status.Allowed = true
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(review)
+	}))
+	defer apiServer.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "tokens.csv")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret,ci,1,\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configFile = filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(configFile, []byte("namespace: [default]\nservice: other\ntimeout: 3s\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	flags := rootCmd.PersistentFlags()
+	previous := map[string][]string{}
+	for _, name := range []string{"namespace", "service", "timeout", "auth", "auth-token-file", "authz-resource"} {
+		previous[name] = flagValue(flags.Lookup(name))
+	}
+	defer func() {
+		for name, value := range previous {
+			_ = setFlag(flags.Lookup(name), value)
+		}
+		configFile, configRules, configFlags, kubeconfigs = "", nil, map[string]bool{}, nil
+	}()
+	namespaces, serviceName = []string{"monitoring"}, "pushgateway"
+	authMethods, authTokenFile, authzResource = []string{"static-token"}, tokenFile, "services"
+	kubeconfigs = map[string]*rest.Config{"": {Host: apiServer.URL}}
+
+	chain, err := newHandlerChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newReloadableHandler(chain)
+	h.SetTargets([]controller.Target{{Address: strings.TrimPrefix(backend.URL, "http://"), Ready: true}})
+	if err := reloadConfig(flags, h); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, timeout, 3*time.Second)
+	assert.Equal(t, namespaces, []string{"monitoring"})
+	assert.Equal(t, serviceName, "pushgateway")
+
+	// The new handler has to authorize the requests against the service the broadcaster was started with.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, req)
+	assert.Equal(t, recorder.Code, http.StatusOK)
+	reviewedMtx.Lock()
+	defer reviewedMtx.Unlock()
+	assert.Equal(t, reviewed, []string{"monitoring/pushgateway"})
+}
+
+func TestApplyEnv(t *testing.T) {
+	var namespaces, headers []string
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.StringSliceVar(&namespaces, "namespace", []string{"default"}, "")
+	flags.StringArrayVar(&headers, "request-header", []string{}, "")
+	env := map[string]string{
+		"BROADCAST_NAMESPACE":      "monitoring,logging",
+		"BROADCAST_REQUEST_HEADER": "set:Accept=text/plain, application/json\n remove:Cookie\n",
+	}
+	for name, value := range env {
+		if err := os.Setenv(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for name := range env {
+			_ = os.Unsetenv(name)
+		}
+		envFlags = map[string]bool{}
+	}()
+
+	assert.Equal(t, applyEnv(flags), nil)
+	assert.Equal(t, namespaces, []string{"monitoring", "logging"})
+	assert.Equal(t, headers, []string{"set:Accept=text/plain, application/json", "remove:Cookie"})
+	assert.Equal(t, envFlags, map[string]bool{"namespace": true, "request-header": true})
+}
@@ -0,0 +1,62 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// discoverySettleTime is how long to wait for further updates after the first one since the discoverers
+// may send multiple updates until they are fully synced.
+const discoverySettleTime = 500 * time.Millisecond
+
+// discoverTargets runs the discovery until it settles and returns the last update.
+func discoverTargets(discoverer controller.Discoverer, timeout time.Duration) (controller.Update, error) {
+	updatesChannel := make(chan controller.Update, 10)
+	if err := discoverer.Start(updatesChannel); err != nil {
+		return controller.Update{}, fmt.Errorf("failed to start targets discovery: %w", err)
+	}
+	defer discoverer.Stop()
+	deadline := time.After(timeout)
+	var update controller.Update
+	select {
+	case update = <-updatesChannel:
+	case <-deadline:
+		return controller.Update{}, fmt.Errorf("no targets discovered in %v", timeout)
+	}
+	for {
+		select {
+		case update = <-updatesChannel:
+		case <-time.After(discoverySettleTime):
+			return update, nil
+		case <-deadline:
+			return update, nil
+		}
+	}
+}
+
+// printTargets prints the targets as table.
+func printTargets(w io.Writer, targets []controller.Target) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "ADDRESS\tCLUSTER\tNAMESPACE\tPOD\tNODE\tZONE\tREADY")
+	for _, t := range targets {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", t.Address, t.Cluster, t.Namespace, t.Pod, t.Node, t.Zone, strconv.FormatBool(t.Ready))
+	}
+	_ = tw.Flush()
+}
@@ -0,0 +1,260 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/auth"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/handler"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// multiplexer is the handler broadcasting the requests to the targets.
+type multiplexer interface {
+	http.Handler
+	backendsHandler
+	SetTargets(targets []controller.Target)
+	Broadcast(ctx context.Context, req *http.Request, targets []controller.Target) []handler.TargetResult
+}
+
+// handlerChain is the handler with all its settings, it is replaced as a whole on reload of the configuration.
+type handlerChain struct {
+	multiplexer  multiplexer
+	server       http.Handler
+	staticRoutes []handler.Route
+	// authMethods are the authentication methods used by default or by any of the static routes.
+	authMethods map[auth.Method]bool
+	authorized  bool
+}
+
+// newHandlerChain creates the handler according to the current flags and configuration.
+func newHandlerChain() (*handlerChain, error) {
+	handlerMode, err := handler.ParseMode(mode)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mode: %w", err)
+	}
+	if handlerMode == handler.ModeConsistentHash && hashHeader == "" {
+		return nil, fmt.Errorf("the consistent-hash mode requires the --hash-header flag")
+	}
+	if hedgePercentile < 0 || hedgePercentile > 1 {
+		return nil, fmt.Errorf("invalid hedge percentile %v, must be between 0 and 1", hedgePercentile)
+	}
+
+	var handlerRoutes, prefixRoutes []handler.Route
+	for i, rule := range configRules {
+		route, err := rule.Route()
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule number %d in the config file: %w", i+1, err)
+		}
+		handlerRoutes = append(handlerRoutes, route)
+	}
+	if rulesFile != "" {
+		fileRoutes, err := handler.LoadRulesFile(rulesFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load rules: %w", err)
+		}
+		handlerRoutes = append(handlerRoutes, fileRoutes...)
+	}
+	for _, r := range routes {
+		route, err := handler.ParseRoute(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route: %w", err)
+		}
+		prefixRoutes = append(prefixRoutes, route)
+	}
+	sortRoutes(prefixRoutes)
+	handlerRoutes = append(handlerRoutes, prefixRoutes...)
+
+	defaultAuth, err := auth.ParseMethods(authMethods)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authentication: %w", err)
+	}
+	usedAuth := authMethodsUsed(defaultAuth, handlerRoutes)
+	authenticators, err := newAuthenticators(usedAuth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid authentication: %w", err)
+	}
+	if authzResource != "" && len(usedAuth) == 0 {
+		return nil, fmt.Errorf("the authorization requires authentication of the requests by the --auth flag")
+	}
+	authorizer, err := newAuthorizer()
+	if err != nil {
+		return nil, fmt.Errorf("invalid authorization: %w", err)
+	}
+	credentials, err := newBackendCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("invalid backend credentials: %w", err)
+	}
+	forwardedMode, err := handler.ParseForwardedMode(forwardedHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid forwarded headers: %w", err)
+	}
+	requestHeaderRules, err := parseHeaderRules(requestHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request header: %w", err)
+	}
+	responseHeaderRules, err := parseHeaderRules(responseHeaders)
+	if err != nil {
+		return nil, fmt.Errorf("invalid response header: %w", err)
+	}
+	rewrite, err := parseRewrite(rewritePath, rewriteQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rewrite: %w", err)
+	}
+
+	h := handler.NewMultiplexingHandler(iface, timeout, allMustSucceed, keepalive)
+	h.SetMode(handlerMode)
+	h.SetHashHeader(hashHeader)
+	h.SetHedging(hedgeDelay, hedgePercentile)
+	h.SetRoutes(handlerRoutes)
+	h.SetCircuitBreaker(breaker)
+	h.SetNotReadyBestEffort(notReadyBestEffort)
+	h.SetLocalZone(localZone)
+	h.SetClusters(kubeContexts)
+	h.SetAuthentication(authenticators, defaultAuth)
+	if authorizer != nil {
+		h.SetAuthorization(authorizer, authzObjects())
+	}
+	h.SetBackendCredentials(credentials, backendStripAuthorization)
+	h.SetForwardedHeaders(forwardedMode)
+	h.SetHeaderRules(requestHeaderRules, responseHeaderRules)
+	h.SetRewrite(rewrite)
+	if successPolicy != "" {
+		policy, err := handler.ParseSuccessPolicy(successPolicy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid success policy: %w", err)
+		}
+		h.SetSuccessPolicy(policy)
+	}
+	return &handlerChain{
+		multiplexer:  h,
+		server:       handler.NewLimitingHandler(h, limits),
+		staticRoutes: handlerRoutes,
+		authMethods:  usedAuth,
+		authorized:   authorizer != nil,
+	}, nil
+}
+
+// sortRoutes orders the routes by length of their path prefix, so the longest prefix wins and the more specific routes go first.
+func sortRoutes(routes []handler.Route) {
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].PathPrefix) > len(routes[j].PathPrefix)
+	})
+}
+
+// parseHeaderRules parses the header rules from the flags, nil if there are none.
+func parseHeaderRules(rules []string) (*handler.HeaderRules, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	var config handler.HeaderRulesConfig
+	for _, r := range rules {
+		if err := config.ParseRule(r); err != nil {
+			return nil, err
+		}
+	}
+	return config.Rules()
+}
+
+// parseRewrite parses the rewrite from the flags, nil if there is none.
+func parseRewrite(path string, query []string) (*handler.Rewrite, error) {
+	if path == "" && len(query) == 0 {
+		return nil, nil
+	}
+	config := handler.RewriteConfig{Path: path}
+	for _, q := range query {
+		if err := config.ParseQuery(q); err != nil {
+			return nil, err
+		}
+	}
+	return config.Rewrite()
+}
+
+// reloadableHandler serves the requests by the current handler chain which can be swapped on reload of the configuration.
+// The in-flight requests are finished by the chain they started with. The targets and routes are kept across the swaps.
+type reloadableHandler struct {
+	current       atomic.Value
+	mtx           sync.Mutex
+	targets       []controller.Target
+	backends      map[string][]controller.Target
+	dynamicRoutes []handler.Route
+}
+
+func newReloadableHandler(chain *handlerChain) *reloadableHandler {
+	r := &reloadableHandler{backends: map[string][]controller.Target{}}
+	r.current.Store(chain)
+	return r
+}
+
+func (r *reloadableHandler) chain() *handlerChain {
+	return r.current.Load().(*handlerChain)
+}
+
+func (r *reloadableHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.chain().server.ServeHTTP(w, req)
+}
+
+// swap replaces the handler chain with new one configured with the current targets and routes.
+func (r *reloadableHandler) swap(chain *handlerChain) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	chain.multiplexer.SetTargets(r.targets)
+	for backend, targets := range r.backends {
+		chain.multiplexer.SetBackendTargets(backend, targets)
+	}
+	chain.multiplexer.SetRoutes(r.routes(chain))
+	r.current.Store(chain)
+}
+
+// routes returns the dynamic routes followed by the static ones of the chain.
+func (r *reloadableHandler) routes(chain *handlerChain) []handler.Route {
+	routes := make([]handler.Route, 0, len(r.dynamicRoutes)+len(chain.staticRoutes))
+	routes = append(routes, r.dynamicRoutes...)
+	return append(routes, chain.staticRoutes...)
+}
+
+func (r *reloadableHandler) SetTargets(targets []controller.Target) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.targets = targets
+	r.chain().multiplexer.SetTargets(targets)
+}
+
+func (r *reloadableHandler) SetBackendTargets(backend string, targets []controller.Target) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.backends[backend] = targets
+	r.chain().multiplexer.SetBackendTargets(backend, targets)
+}
+
+func (r *reloadableHandler) RemoveBackend(backend string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	delete(r.backends, backend)
+	r.chain().multiplexer.RemoveBackend(backend)
+}
+
+// SetRoutes sets the dynamic routes which take precedence over the static ones.
+func (r *reloadableHandler) SetRoutes(routes []handler.Route) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.dynamicRoutes = routes
+	chain := r.chain()
+	chain.multiplexer.SetRoutes(r.routes(chain))
+}
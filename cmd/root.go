@@ -22,6 +22,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"net"
@@ -34,32 +35,96 @@ import (
 )
 
 var (
-	iface, metricsIface, kubeconfigPath, namespace, logLevel, serviceName, portName string
-	keepalive, allMustSucceed                                                       bool
-	timeout                                                                         time.Duration
-	kubeconfig                                                                      *rest.Config
+	iface, metricsIface, kubeconfigPath, logLevel, serviceName, selector, port, targetsFile, dnsName, dnsSRV, mode, hashHeader, rulesFile, successPolicy, localZone, configFile, authTokenFile, authHtpasswdFile, authzVerb, authzGroup, authzResource, authzSubresource, backendTokenFile, backendBasicAuthUser, backendBasicAuthPasswordFile, forwardedHeaders, rewritePath string
+	keepalive, allMustSucceed, includeNotReady, includeTerminating, notReadyBestEffort, resolveZones, watchServices, watchRoutes, routesCrossNamespace, backendServiceAccountToken, backendStripAuthorization                                                                                                                                                                 bool
+	timeout, hedgeDelay, targetsFileRefresh, dnsRefresh, configRefresh, authCacheTTL, backendCredentialsRefresh                                                                                                                                                                                                                                                               time.Duration
+	hedgePercentile                                                                                                                                                                                                                                                                                                                                                           float64
+	routes, staticTargets, namespaces, kubeContexts, authMethods, authTokenReviewAudiences, requestHeaders, responseHeaders, rewriteQuery                                                                                                                                                                                                                                     []string
+	limits                                                                                                                                                                                                                                                                                                                                                                    handler.LimitsConfig
+	breaker                                                                                                                                                                                                                                                                                                                                                                   handler.BreakerConfig
+	kubeconfigs                                                                                                                                                                                                                                                                                                                                                               map[string]*rest.Config
 
 	rootCmd = &cobra.Command{
 		Use:   "k8s-service-broadcasting",
 		Short: "Broadcast HTTP to all service endpoints.",
 		Long: "Tool allowing to broadcast/mirror/duplicate HTTP requests to all endpoints of Kubernetes service.\n" +
-			"Waits for all of them to end and reports back failed request if any. If not returns last successful.",
+			"Waits for all of them to end and reports back failed request if any. If not returns last successful.\n\n" +
+			"Every flag can be set also by environment variable with the " + envPrefix + " prefix, e.g. " + envPrefix + "SUCCESS_POLICY.\n" +
+			"Values of the list flags are comma separated, values of the repeatable flags such as --route are separated by new lines.\n" +
+			"Precedence is flag > environment variable > config file > default.",
 		Run: runMultiplexer,
 	}
 )
 
 func init() {
 	cobra.OnInitialize(configure)
-	rootCmd.Flags().StringVarP(&iface, "interface", "i", "0.0.0.0:8080", "Interface to listen on.")
-	rootCmd.Flags().StringVarP(&metricsIface, "metrics-interface", "m", "0.0.0.0:8081", "Interface for exposing metrics.")
-	rootCmd.Flags().StringVarP(&kubeconfigPath, "kubeconfig", "k", os.Getenv("KUBECONFIG"), "Location of the kubeconfig, default if in cluster config or value of KUBECONFIG env variable.")
-	rootCmd.Flags().StringVarP(&serviceName, "service", "s", "", "Name of service to sed the requests to.")
-	rootCmd.Flags().StringVarP(&portName, "port-name", "p", "", "Name of service port to sed the requests to.")
-	rootCmd.Flags().StringVarP(&namespace, "namespace", "n", "", "Namespace to watch for.")
-	rootCmd.Flags().BoolVar(&allMustSucceed, "all-must-succeed", true, "By default if any backend fails, the whole request fails. If disabled one succeeded response is enough.")
-	rootCmd.Flags().StringVarP(&logLevel, "log-level", "l", "info", "Log level (debug, info, warning, ...) default info.")
-	rootCmd.Flags().DurationVarP(&timeout, "timeout", "t", time.Second*10, "Timeout for mirrored requests.")
-	rootCmd.Flags().BoolVar(&keepalive, "keepalive", true, "If keepalive should be enabled.")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "YAML config file with values of the flags under their names and `rules` in the format of the --rules-file evaluated before them. Flags set on the command line take precedence. Reloaded on SIGHUP or change.")
+	rootCmd.PersistentFlags().DurationVar(&configRefresh, "config-refresh", time.Second*10, "How often to check the --config file for changes. Disabled if 0.")
+	rootCmd.PersistentFlags().StringVarP(&iface, "interface", "i", "0.0.0.0:8080", "Interface to listen on.")
+	rootCmd.PersistentFlags().StringVarP(&metricsIface, "metrics-interface", "m", "0.0.0.0:8081", "Interface for exposing metrics.")
+	rootCmd.PersistentFlags().StringVarP(&kubeconfigPath, "kubeconfig", "k", os.Getenv("KUBECONFIG"), "Location of the kubeconfig, default if in cluster config or value of KUBECONFIG env variable.")
+	rootCmd.PersistentFlags().StringVarP(&serviceName, "service", "s", "", "Name of service to sed the requests to.")
+	rootCmd.PersistentFlags().StringVar(&selector, "selector", "", "Label selector of pods to send the requests to, alternative to --service for workloads without a Service.")
+	rootCmd.PersistentFlags().StringSliceVar(&staticTargets, "targets", []string{}, "Static list of targets in the host:port format, alternative to --service for environments without Kubernetes.")
+	rootCmd.PersistentFlags().StringVar(&targetsFile, "targets-file", "", "YAML or JSON file with list of targets under the `targets` key, reloaded on change. Alternative to --service for environments without Kubernetes.")
+	rootCmd.PersistentFlags().DurationVar(&targetsFileRefresh, "targets-file-refresh", time.Second*5, "How often to check the --targets-file for changes.")
+	rootCmd.PersistentFlags().StringVar(&dnsName, "dns-name", "", "DNS name (e.g. of headless service) resolved to A/AAAA records of targets, requires numeric --port. Alternative to --service without access to the Kubernetes API.")
+	rootCmd.PersistentFlags().StringVar(&dnsSRV, "dns-srv", "", "DNS SRV record resolved to targets with ports. Alternative to --service without access to the Kubernetes API.")
+	rootCmd.PersistentFlags().DurationVar(&dnsRefresh, "dns-refresh", time.Second*10, "How often to resolve the --dns-name or --dns-srv.")
+	rootCmd.PersistentFlags().BoolVar(&watchServices, "watch-services", false, "Watch Services annotated with broadcasting.fusakla.io/enabled=true and route requests to them by host or path prefix from their annotations. Can be used instead or together with --service.")
+	rootCmd.PersistentFlags().BoolVar(&watchRoutes, "watch-broadcast-routes", false, "Watch BroadcastRoute custom resources and route requests matching them to their services. Can be used instead or together with --service.")
+	rootCmd.PersistentFlags().BoolVar(&routesCrossNamespace, "broadcast-routes-cross-namespace", false, "Allow the BroadcastRoute resources to route to services in other namespaces than their own.")
+	rootCmd.PersistentFlags().StringVarP(&port, "port", "p", "", "Name or number of the service port or number of the endpoint (target) port to send the requests to. Can be omitted if the service has only single port.")
+	rootCmd.PersistentFlags().StringVar(&port, "port-name", "", "Name of service port to sed the requests to.")
+	if err := rootCmd.PersistentFlags().MarkDeprecated("port-name", "use --port instead"); err != nil {
+		log.Fatal(err)
+	}
+	rootCmd.PersistentFlags().StringSliceVarP(&namespaces, "namespace", "n", []string{}, "Namespace to watch for, can be repeated to broadcast to the service in multiple namespaces. Defaults to namespace of the pod if running in the cluster, set to empty string to watch all namespaces.")
+	rootCmd.PersistentFlags().StringSliceVar(&kubeContexts, "kube-context", []string{}, "Context of the kubeconfig to use, can be repeated to broadcast to the service in multiple clusters. Targets are tagged with the context name as the cluster.")
+	rootCmd.PersistentFlags().BoolVar(&allMustSucceed, "all-must-succeed", true, "By default if any backend fails, the whole request fails. If disabled one succeeded response is enough.")
+	rootCmd.PersistentFlags().StringVar(&successPolicy, "success-policy", "", "When is the broadcasted request successful, one of all, any, one-per-cluster (at least one success in each cluster) or one-per-zone (at least one success in each zone, requires --resolve-zones). Overrides the --all-must-succeed.")
+	rootCmd.PersistentFlags().BoolVar(&resolveZones, "resolve-zones", false, "Tag the endpoints with zone of their node from the topology.kubernetes.io/zone label. Requires list and watch of nodes granted by a ClusterRole.")
+	rootCmd.PersistentFlags().StringVar(&localZone, "local-zone", "", "Send the requests only to the endpoints in this zone, all endpoints are used if there is none in the zone. Requires --resolve-zones.")
+	rootCmd.PersistentFlags().StringVarP(&logLevel, "log-level", "l", "info", "Log level (debug, info, warning, ...) default info.")
+	rootCmd.PersistentFlags().DurationVarP(&timeout, "timeout", "t", time.Second*10, "Timeout for mirrored requests.")
+	rootCmd.PersistentFlags().BoolVar(&includeNotReady, "include-not-ready", false, "Broadcast also to endpoints which are not ready yet, e.g. warming up pods. Requires access to pods.")
+	rootCmd.PersistentFlags().BoolVar(&includeTerminating, "include-terminating", false, "Broadcast also to endpoints of terminating pods. Requires access to pods and services.")
+	rootCmd.PersistentFlags().BoolVar(&notReadyBestEffort, "not-ready-best-effort", false, "Ignore responses of the not ready and terminating endpoints when deciding if the request succeeded.")
+	rootCmd.PersistentFlags().BoolVar(&keepalive, "keepalive", true, "If keepalive should be enabled.")
+	rootCmd.PersistentFlags().StringVar(&mode, "mode", string(handler.ModeBroadcast), "How to distribute requests to the endpoints, broadcast to all of them, hedged (send to one and to another if it does not respond in time) or to single one using round-robin, least-in-flight or consistent-hash.")
+	rootCmd.PersistentFlags().StringVar(&hashHeader, "hash-header", "", "Header used to pick the endpoint in the consistent-hash mode.")
+	rootCmd.PersistentFlags().DurationVar(&hedgeDelay, "hedge-delay", time.Millisecond*100, "In hedged mode, delay after which the request is sent to another endpoint.")
+	rootCmd.PersistentFlags().StringArrayVar(&routes, "route", []string{}, "Override the mode for requests with given path prefix in format <path-prefix>=<mode>, for the consistent-hash mode <path-prefix>=consistent-hash:<header>. Supported modes are broadcast, hedged, round-robin, least-in-flight and consistent-hash. Can be repeated.")
+	rootCmd.PersistentFlags().StringVar(&rulesFile, "rules-file", "", "YAML file with rules deciding by method, path and headers how to handle the request. Evaluated in order before the --route flags, first match wins.")
+	rootCmd.PersistentFlags().Float64Var(&hedgePercentile, "hedge-percentile", 0, "In hedged mode, use this percentile (0-1) of observed latencies as the hedge delay instead of the fixed one. Disabled if 0.")
+	rootCmd.PersistentFlags().Float64Var(&limits.Rate, "rate-limit", 0, "Maximum number of incoming requests per second from all clients. Disabled if 0.")
+	rootCmd.PersistentFlags().IntVar(&limits.Burst, "rate-limit-burst", 0, "Burst of the --rate-limit, defaults to the rate.")
+	rootCmd.PersistentFlags().Float64Var(&limits.ClientRate, "client-rate-limit", 0, "Maximum number of incoming requests per second from single client IP. Disabled if 0.")
+	rootCmd.PersistentFlags().IntVar(&limits.ClientBurst, "client-rate-limit-burst", 0, "Burst of the --client-rate-limit, defaults to the rate.")
+	rootCmd.PersistentFlags().IntVar(&limits.MaxInFlight, "max-in-flight", 0, "Maximum number of incoming requests being broadcasted at once. Disabled if 0.")
+	rootCmd.PersistentFlags().DurationVar(&limits.QueueTimeout, "queue-timeout", 0, "How long can the request wait in queue for the limits, if 0 it is rejected immediately with 429 or 503.")
+	rootCmd.PersistentFlags().IntVar(&breaker.FailureThreshold, "circuit-breaker-failures", 0, "Number of consecutive failures of endpoint after which requests to it are short-circuited. Disabled if 0.")
+	rootCmd.PersistentFlags().DurationVar(&breaker.OpenDuration, "circuit-breaker-open-duration", time.Second*30, "How long are requests to failing endpoint short-circuited before trying it again.")
+	rootCmd.PersistentFlags().StringSliceVar(&authMethods, "auth", []string{}, "Authentication methods of which any has to authenticate the incoming requests, static-token, basic or token-review. Rules can override it by the auth field, none allows anonymous requests. Disabled if empty.")
+	rootCmd.PersistentFlags().StringVar(&authTokenFile, "auth-token-file", "", "CSV file with static bearer tokens in the format token,user,uid,\"group1,group2\" for the static-token authentication.")
+	rootCmd.PersistentFlags().StringVar(&authHtpasswdFile, "auth-htpasswd-file", "", "htpasswd file with bcrypt hashed passwords for the basic authentication.")
+	rootCmd.PersistentFlags().StringSliceVar(&authTokenReviewAudiences, "auth-token-review-audience", []string{}, "Audience the tokens verified by the token-review authentication have to be issued for, can be repeated. Defaults to the audience of the API server.")
+	rootCmd.PersistentFlags().DurationVar(&authCacheTTL, "auth-cache-ttl", time.Minute, "How long to cache results of the token and access reviews and verified passwords. Disabled if 0.")
+	rootCmd.PersistentFlags().StringVar(&authzResource, "authz-resource", "", "Resource the authenticated users have to be allowed to access by the Kubernetes SubjectAccessReview, e.g. services. The object name is the service the request is sent to. Disabled if empty.")
+	rootCmd.PersistentFlags().StringVar(&authzGroup, "authz-group", "", "API group of the --authz-resource.")
+	rootCmd.PersistentFlags().StringVar(&authzSubresource, "authz-subresource", "", "Subresource of the --authz-resource.")
+	rootCmd.PersistentFlags().StringVar(&authzVerb, "authz-verb", "broadcast", "Verb the authenticated users have to be allowed on the --authz-resource.")
+	rootCmd.PersistentFlags().StringVar(&backendTokenFile, "backend-token-file", "", "File with bearer token sent to the endpoints instead of the credentials of the client, re-read every --backend-credentials-refresh to pick up the rotated token.")
+	rootCmd.PersistentFlags().BoolVar(&backendServiceAccountToken, "backend-service-account-token", false, "Send token of the service account of the broadcaster to the endpoints instead of the credentials of the client.")
+	rootCmd.PersistentFlags().StringVar(&backendBasicAuthUser, "backend-basic-auth-user", "", "User sent to the endpoints by HTTP basic authentication instead of the credentials of the client, requires --backend-basic-auth-password-file.")
+	rootCmd.PersistentFlags().StringVar(&backendBasicAuthPasswordFile, "backend-basic-auth-password-file", "", "File with password of the --backend-basic-auth-user, re-read every --backend-credentials-refresh.")
+	rootCmd.PersistentFlags().DurationVar(&backendCredentialsRefresh, "backend-credentials-refresh", time.Minute, "How often to re-read the files with the backend credentials.")
+	rootCmd.PersistentFlags().BoolVar(&backendStripAuthorization, "backend-strip-authorization", false, "Do not send the Authorization header of the client to the endpoints.")
+	rootCmd.PersistentFlags().StringVar(&forwardedHeaders, "forwarded-headers", string(handler.ForwardedAppend), "How to set the X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host and Forwarded headers of the requests sent to the endpoints, append the client to the incoming ones, replace them (for untrusted clients) or off to pass them unchanged.")
+	rootCmd.PersistentFlags().StringArrayVar(&requestHeaders, "request-header", []string{}, "Header of the requests sent to the endpoints in format set:<name>=<value>, add:<name>=<value> or remove:<name>. The value is Go template with the .Target (e.g. {{ .Target.Address }} or {{ .Target.Pod }}) and the incoming .Request. Can be repeated.")
+	rootCmd.PersistentFlags().StringArrayVar(&responseHeaders, "response-header", []string{}, "Header of the responses in the same format as --request-header, the .Target is the endpoint which returned the response. Can be repeated.")
+	rootCmd.PersistentFlags().StringVar(&rewritePath, "rewrite-path", "", "Path of the requests sent to each of the endpoints, Go template with the .Target, its .Index among the discovered endpoints, .Ordinal from the numeric suffix of the pod name and the incoming .Request, e.g. {{ .Request.URL.Path }}/{{ .Ordinal }}.")
+	rootCmd.PersistentFlags().StringArrayVar(&rewriteQuery, "rewrite-query", []string{}, "Query parameter of the requests sent to each of the endpoints in format <name>=<value>, the value is template as in --rewrite-path. Can be repeated.")
 }
 
 // Execute executes the root command.
@@ -74,47 +139,159 @@ func configure() {
 		FullTimestamp: true,
 	})
 	log.SetOutput(os.Stdout)
+	recordFlags(rootCmd.PersistentFlags())
+	if err := applyEnv(rootCmd.PersistentFlags()); err != nil {
+		log.Fatalf("Failed to load environment variables: %v", err)
+	}
+	if err := loadConfig(rootCmd.PersistentFlags()); err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	defaultNamespace()
+	configLastReloadSuccess.Set(1)
 	lvl, err := log.ParseLevel(logLevel)
 	if err != nil {
 		log.Fatalf("Failed to parse log level, error: %v", err)
 	}
 	log.SetLevel(lvl)
+}
 
+// loadKubeconfigs loads the kubeconfig for each of the clusters, it is needed only for the Kubernetes based discovery.
+func loadKubeconfigs() error {
+	kubeconfigs = map[string]*rest.Config{}
+	if len(kubeContexts) > 0 {
+		for _, c := range kubeContexts {
+			loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+			loadingRules.ExplicitPath = kubeconfigPath
+			config, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{CurrentContext: c}).ClientConfig()
+			if err != nil {
+				return fmt.Errorf("failed to load kubeconfig context %v: %w", c, err)
+			}
+			kubeconfigs[c] = config
+		}
+		return nil
+	}
+	var config *rest.Config
+	var err error
 	if kubeconfigPath == "" {
-		kubeconfig, err = rest.InClusterConfig()
+		config, err = rest.InClusterConfig()
+	} else {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	kubeconfigs[""] = config
+	return nil
+}
+
+// usesKubernetes returns true if the Kubernetes API is needed for the discovery.
+func usesKubernetes() bool {
+	return selector != "" || serviceName != "" || watchServices || watchRoutes
+}
+
+// newDiscoverer returns the discoverer of targets according to the flags,
+// if multiple sources of targets are set, their targets are merged.
+func newDiscoverer() (controller.Discoverer, error) {
+	var discoverers []controller.Discoverer
+	add := func(d controller.Discoverer, err error) error {
 		if err != nil {
-			log.Fatalf("Failed to load kubeconfig: %v", err)
+			return err
 		}
-	} else {
-		kubeconfig, err = clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+		discoverers = append(discoverers, d)
+		return nil
+	}
+	if len(staticTargets) > 0 {
+		if err := add(controller.NewStaticController(staticTargets)); err != nil {
+			return nil, err
+		}
+	}
+	if targetsFile != "" {
+		if err := add(controller.NewFileController(targetsFile, targetsFileRefresh)); err != nil {
+			return nil, err
+		}
+	}
+	if dnsName != "" {
+		if err := add(controller.NewDNSController(net.DefaultResolver, dnsName, false, port, dnsRefresh)); err != nil {
+			return nil, err
+		}
+	}
+	if dnsSRV != "" {
+		if err := add(controller.NewDNSController(net.DefaultResolver, dnsSRV, true, port, dnsRefresh)); err != nil {
+			return nil, err
+		}
+	}
+	if usesKubernetes() {
+		if err := loadKubeconfigs(); err != nil {
+			return nil, err
+		}
+	}
+	for cluster, config := range kubeconfigs {
+		clientset, err := kubernetes.NewForConfig(config)
 		if err != nil {
-			log.Fatalf("Failed to load kubeconfig: %v", err)
+			return nil, fmt.Errorf("failed to create client of cluster %q: %w", cluster, err)
+		}
+		for _, namespace := range watchedNamespaces() {
+			namespace := namespace
+			if selector != "" {
+				if err := add(controller.NewPodController(clientset, cluster, &namespace, selector, port, resolveZones)); err != nil {
+					return nil, err
+				}
+			}
+			if serviceName != "" {
+				if err := add(controller.NewEndpointController(clientset, cluster, &namespace, serviceName, port, includeNotReady, includeTerminating, resolveZones)); err != nil {
+					return nil, err
+				}
+			}
 		}
 	}
+	switch len(discoverers) {
+	case 0:
+		if watchServices || watchRoutes {
+			// All targets come from the watched resources.
+			return nil, nil
+		}
+		return nil, fmt.Errorf("at least one of the --service, --selector, --targets, --targets-file, --dns-name or --dns-srv flags has to be set")
+	case 1:
+		return discoverers[0], nil
+	}
+	return controller.NewCompositeDiscoverer(discoverers...), nil
 }
 
 func runMultiplexer(cmd *cobra.Command, _ []string) {
-	if err := cmd.MarkFlagRequired("service"); err != nil {
-		log.Warn(err)
-	}
-	if err := cmd.MarkFlagRequired("port-name"); err != nil {
-		log.Warn(err)
-	}
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	var status = readiness.New()
 
-	updatesChannel := make(chan *[]string, 10)
+	updatesChannel := make(chan controller.Update, 10)
 	shutdownChannel := make(chan struct{}, 3)
 	srvErrChannel := make(chan error)
 	signals := make(chan os.Signal, 10)
 
-	endpointController, err := controller.NewEndpointController(kubeconfig, &namespace, serviceName, portName, updatesChannel)
+	discoverer, err := newDiscoverer()
 	if err != nil {
-		log.Fatalf("Failed to initialize k8s endpoint watcher: %v", err)
+		log.Fatalf("Failed to initialize targets discovery: %v", err)
+	}
+	if discoverer == nil {
+		status.Ready()
+	} else if err := discoverer.Start(updatesChannel); err != nil {
+		log.Fatalf("Failed to start targets discovery: %v", err)
 	}
 
-	h := handler.NewMultiplexingHandler(iface, timeout, allMustSucceed, keepalive)
+	chain, err := newHandlerChain()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	h := newReloadableHandler(chain)
+	var backends *dynamicBackends
+	if watchServices || watchRoutes {
+		backends = newDynamicBackends(h)
+	}
+	if watchServices {
+		backends.watchServices()
+	}
+	if watchRoutes {
+		backends.watchBroadcastRoutes()
+	}
 
 	listener, err := net.Listen("tcp", iface)
 	if err != nil {
@@ -153,7 +330,21 @@ func runMultiplexer(cmd *cobra.Command, _ []string) {
 		}
 	}()
 
-	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	var configRefreshChannel <-chan time.Time
+	if configFile != "" && configRefresh > 0 {
+		ticker := time.NewTicker(configRefresh)
+		defer ticker.Stop()
+		configRefreshChannel = ticker.C
+	}
+	reload := func() {
+		if err := reloadConfig(cmd.Root().PersistentFlags(), h); err != nil {
+			log.Errorf("Failed to reload config, keeping the previous one: %v", err)
+			return
+		}
+		log.Infof("Reloaded config from %v", configFile)
+	}
 
 	run := true
 	for run {
@@ -162,15 +353,29 @@ func runMultiplexer(cmd *cobra.Command, _ []string) {
 			if !ok {
 				continue
 			}
+			if sig == syscall.SIGHUP {
+				log.Info("Received SIGHUP, reloading config...")
+				reload()
+				continue
+			}
 			log.Infof("Received signal %v, terminating...", sig)
 			shutdownChannel <- struct{}{}
+		case <-configRefreshChannel:
+			if configChanged() {
+				reload()
+			}
 		case <-srvErrChannel:
 			shutdownChannel <- struct{}{}
 		case <-shutdownChannel:
 			status.NotReady(fmt.Errorf("shutting down"))
 			ctx, cancelFunc := context.WithTimeout(context.Background(), time.Second*5)
-			log.Info("Stopping k8s endpoint controller...")
-			endpointController.StopController()
+			log.Info("Stopping targets discovery...")
+			if discoverer != nil {
+				discoverer.Stop()
+			}
+			if backends != nil {
+				backends.stop()
+			}
 			log.Info("Stopping web server...")
 			if err := server.Shutdown(ctx); err != nil {
 				log.Errorf("Failed to gracefully stop server, error: %v", err)
@@ -179,11 +384,15 @@ func runMultiplexer(cmd *cobra.Command, _ []string) {
 			cancelFunc()
 			run = false
 			break
-		case ips, ok := <-updatesChannel:
+		case update, ok := <-updatesChannel:
 			if ok {
-				status.Ready()
-				log.Infof("Updating targets with new addresses: %v", *ips)
-				h.SetTargetAddresses(*ips)
+				if update.Err != nil {
+					status.NotReady(update.Err)
+				} else {
+					status.Ready()
+				}
+				log.Infof("Updating targets with new addresses: %v", controller.Addresses(update.Targets))
+				h.SetTargets(update.Targets)
 				continue
 			}
 		}
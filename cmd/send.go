@@ -0,0 +1,193 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/handler"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// maxTableBodyLength is maximum length of the response body printed in the table.
+const maxTableBodyLength = 60
+
+var (
+	sendMethod, sendData, sendDataFile, sendOutput string
+	sendHeaders                                    []string
+
+	sendCmd = &cobra.Command{
+		Use:   "send <path>",
+		Short: "Send single request to all the discovered targets and print their responses.",
+		Long: "Discovers the targets using the same flags as the broadcaster, sends the request to all of them\n" +
+			"and prints result of each of them. Exits with non zero code if the request fails according to the success policy.",
+		Example: "  k8s-service-broadcasting send --service pushgateway --namespace monitoring -X DELETE /metrics/job/test",
+		Args:    cobra.ExactArgs(1),
+		Run:     runSend,
+	}
+)
+
+func init() {
+	sendCmd.Flags().StringVarP(&sendMethod, "method", "X", http.MethodGet, "HTTP method of the request.")
+	sendCmd.Flags().StringVarP(&sendData, "data", "d", "", "Body of the request.")
+	sendCmd.Flags().StringVar(&sendDataFile, "data-file", "", "File with body of the request, - for stdin.")
+	sendCmd.Flags().StringArrayVarP(&sendHeaders, "header", "H", []string{}, "Header of the request in format <name>: <value>. Can be repeated.")
+	sendCmd.Flags().StringVarP(&sendOutput, "output", "o", "table", "Output format, table or json.")
+	sendCmd.Flags().DurationVar(&discoveryTimeout, "discovery-timeout", discoveryTimeout, "How long to wait for the targets to be discovered.")
+	rootCmd.AddCommand(sendCmd)
+}
+
+// newSendRequest creates the request from the flags.
+func newSendRequest(path string) (*http.Request, error) {
+	var body []byte
+	var err error
+	switch {
+	case sendDataFile == "-":
+		body, err = ioutil.ReadAll(os.Stdin)
+	case sendDataFile != "":
+		body, err = ioutil.ReadFile(sendDataFile)
+	default:
+		body = []byte(sendData)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	req, err := http.NewRequest(strings.ToUpper(sendMethod), path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range sendHeaders {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid header %v, expected format is <name>: <value>", h)
+		}
+		req.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	return req, nil
+}
+
+// sendPolicy returns the success policy according to the flags.
+func sendPolicy() (handler.SuccessPolicy, error) {
+	if successPolicy != "" {
+		return handler.ParseSuccessPolicy(successPolicy)
+	}
+	if allMustSucceed {
+		return handler.PolicyAll, nil
+	}
+	return handler.PolicyAny, nil
+}
+
+type sendResult struct {
+	Address         string  `json:"address"`
+	Cluster         string  `json:"cluster,omitempty"`
+	Namespace       string  `json:"namespace,omitempty"`
+	Pod             string  `json:"pod,omitempty"`
+	Node            string  `json:"node,omitempty"`
+	Zone            string  `json:"zone,omitempty"`
+	StatusCode      int     `json:"status_code"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Body            string  `json:"body"`
+}
+
+func printSendResults(w io.Writer, results []handler.TargetResult, format string) error {
+	switch format {
+	case "json":
+		var out []sendResult
+		for _, r := range results {
+			out = append(out, sendResult{
+				Address:         r.Target.Address,
+				Cluster:         r.Target.Cluster,
+				Namespace:       r.Target.Namespace,
+				Pod:             r.Target.Pod,
+				Node:            r.Target.Node,
+				Zone:            r.Target.Zone,
+				StatusCode:      r.StatusCode,
+				DurationSeconds: r.Duration.Seconds(),
+				Body:            string(r.Body),
+			})
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		encoder.SetEscapeHTML(false)
+		return encoder.Encode(out)
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw, "ADDRESS\tPOD\tNODE\tSTATUS\tDURATION\tBODY")
+		for _, r := range results {
+			body := strings.Join(strings.Fields(string(r.Body)), " ")
+			if len(body) > maxTableBodyLength {
+				body = body[:maxTableBodyLength] + "..."
+			}
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%v\t%s\n", r.Target.Address, r.Target.Pod, r.Target.Node, r.StatusCode, r.Duration.Round(time.Microsecond), body)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown output format %v, supported are table and json", format)
+}
+
+func runSend(cmd *cobra.Command, args []string) {
+	req, err := newSendRequest(args[0])
+	if err != nil {
+		log.Fatalf("Invalid request: %v", err)
+	}
+	policy, err := sendPolicy()
+	if err != nil {
+		log.Fatalf("Invalid success policy: %v", err)
+	}
+	if sendOutput != "table" && sendOutput != "json" {
+		log.Fatalf("Unknown output format %v, supported are table and json", sendOutput)
+	}
+	discoverer, err := newDiscoverer()
+	if err != nil {
+		log.Fatalf("Failed to initialize targets discovery: %v", err)
+	}
+	if discoverer == nil {
+		log.Fatal("The send command requires one of the --service, --selector, --targets, --targets-file, --dns-name or --dns-srv flags")
+	}
+	update, err := discoverTargets(discoverer, discoveryTimeout)
+	if err != nil {
+		log.Fatalf("Failed to discover targets: %v", err)
+	}
+	if update.Err != nil {
+		log.Errorf("Failed to discover some of the targets: %v", update.Err)
+	}
+	if len(update.Targets) == 0 {
+		log.Fatal("No targets found")
+	}
+	// The request is sent with the same credentials, headers, rewrites, timeout and retries as when serving.
+	chain, err := newHandlerChain()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	results := chain.multiplexer.Broadcast(context.Background(), req, update.Targets)
+	if err := printSendResults(cmd.OutOrStdout(), results, sendOutput); err != nil {
+		log.Fatalf("Failed to print results: %v", err)
+	}
+	if !policy.Succeeded(results, kubeContexts) {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	targetsWatch  bool
+	targetsOutput string
+
+	targetsCmd = &cobra.Command{
+		Use:   "targets",
+		Short: "Print the discovered targets.",
+		Long: "Runs the discovery of targets using the same flags as the broadcaster and prints them with their metadata.\n" +
+			"In the watch mode prints every update of the targets until interrupted.",
+		Example: "  k8s-service-broadcasting targets --service pushgateway --namespace monitoring --port http --watch",
+		Args:    cobra.NoArgs,
+		Run:     runTargets,
+	}
+)
+
+func init() {
+	targetsCmd.Flags().BoolVarP(&targetsWatch, "watch", "w", false, "Print every update of the targets until interrupted.")
+	targetsCmd.Flags().StringVarP(&targetsOutput, "output", "o", "table", "Output format, table or json.")
+	targetsCmd.Flags().DurationVar(&discoveryTimeout, "discovery-timeout", discoveryTimeout, "How long to wait for the targets to be discovered.")
+	rootCmd.AddCommand(targetsCmd)
+}
+
+type targetOutput struct {
+	Address   string            `json:"address"`
+	Cluster   string            `json:"cluster,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+	Pod       string            `json:"pod,omitempty"`
+	Node      string            `json:"node,omitempty"`
+	Zone      string            `json:"zone,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Ready     bool              `json:"ready"`
+}
+
+// printUpdate prints the targets of the update and the discovery error if any.
+func printUpdate(w io.Writer, update controller.Update, format string) error {
+	if update.Err != nil {
+		log.Errorf("Failed to discover some of the targets: %v", update.Err)
+	}
+	switch format {
+	case "json":
+		out := []targetOutput{}
+		for _, t := range update.Targets {
+			out = append(out, targetOutput{Address: t.Address, Cluster: t.Cluster, Namespace: t.Namespace, Pod: t.Pod, Node: t.Node, Zone: t.Zone, Labels: t.Labels, Ready: t.Ready})
+		}
+		return json.NewEncoder(w).Encode(out)
+	case "table":
+		printTargets(w, update.Targets)
+		return nil
+	}
+	return fmt.Errorf("unknown output format %v, supported are table and json", format)
+}
+
+func runTargets(cmd *cobra.Command, _ []string) {
+	if targetsOutput != "table" && targetsOutput != "json" {
+		log.Fatalf("Unknown output format %v, supported are table and json", targetsOutput)
+	}
+	discoverer, err := newDiscoverer()
+	if err != nil {
+		log.Fatalf("Failed to initialize targets discovery: %v", err)
+	}
+	if discoverer == nil {
+		log.Fatal("The targets command requires one of the --service, --selector, --targets, --targets-file, --dns-name or --dns-srv flags")
+	}
+	out := cmd.OutOrStdout()
+	if !targetsWatch {
+		update, err := discoverTargets(discoverer, discoveryTimeout)
+		if err != nil {
+			log.Fatalf("Failed to discover targets: %v", err)
+		}
+		if err := printUpdate(out, update, targetsOutput); err != nil {
+			log.Fatalf("Failed to print targets: %v", err)
+		}
+		return
+	}
+
+	updatesChannel := make(chan controller.Update, 10)
+	if err := discoverer.Start(updatesChannel); err != nil {
+		log.Fatalf("Failed to start targets discovery: %v", err)
+	}
+	defer discoverer.Stop()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	for {
+		select {
+		case <-signals:
+			return
+		case update := <-updatesChannel:
+			if targetsOutput == "table" {
+				_, _ = fmt.Fprintf(out, "\n%v %d targets\n", time.Now().Format(time.RFC3339), len(update.Targets))
+			}
+			if err := printUpdate(out, update, targetsOutput); err != nil {
+				log.Fatalf("Failed to print targets: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"github.com/magiconair/properties/assert"
+	"testing"
+)
+
+func TestPrintUpdate(t *testing.T) {
+	update := controller.Update{
+		Targets: []controller.Target{
+			{Address: "10.0.0.1:9091", Cluster: "eu", Namespace: "monitoring", Pod: "pushgateway-0", Node: "node-1", Zone: "eu-1a", Labels: map[string]string{"app": "pushgateway"}, Ready: true},
+			{Address: "10.0.0.2:9091", Ready: false},
+		},
+		Err: errors.New("cluster us unreachable"),
+	}
+
+	var table bytes.Buffer
+	assert.Equal(t, printUpdate(&table, update, "table"), nil)
+	assert.Equal(t, table.String(), ""+
+		"ADDRESS        CLUSTER  NAMESPACE   POD            NODE    ZONE   READY\n"+
+		"10.0.0.1:9091  eu       monitoring  pushgateway-0  node-1  eu-1a  true\n"+
+		"10.0.0.2:9091                                                     false\n")
+
+	var json bytes.Buffer
+	assert.Equal(t, printUpdate(&json, update, "json"), nil)
+	assert.Equal(t, json.String(), `[{"address":"10.0.0.1:9091","cluster":"eu","namespace":"monitoring","pod":"pushgateway-0","node":"node-1","zone":"eu-1a","labels":{"app":"pushgateway"},"ready":true},{"address":"10.0.0.2:9091","ready":false}]`+"\n")
+
+	json.Reset()
+	assert.Equal(t, printUpdate(&json, controller.Update{}, "json"), nil)
+	assert.Equal(t, json.String(), "[]\n")
+
+	if err := printUpdate(&json, update, "yaml"); err == nil {
+		t.Error("expected error for unknown output format")
+	}
+}
+
+func TestRunTargets(t *testing.T) {
+	defer func() {
+		staticTargets, targetsOutput, targetsWatch = []string{}, "table", false
+		targetsCmd.SetOutput(nil)
+	}()
+	staticTargets, targetsOutput, targetsWatch = []string{"10.0.0.1:9091", "10.0.0.2:9091"}, "json", false
+	var out bytes.Buffer
+	targetsCmd.SetOutput(&out)
+
+	runTargets(targetsCmd, nil)
+	assert.Equal(t, out.String(), `[{"address":"10.0.0.1:9091","ready":true},{"address":"10.0.0.2:9091","ready":true}]`+"\n")
+}
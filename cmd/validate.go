@@ -0,0 +1,144 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/auth"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"github.com/spf13/cobra"
+	"k8s.io/client-go/kubernetes"
+	"os"
+	"time"
+)
+
+var (
+	discoveryTimeout = time.Second * 10
+
+	validateCmd = &cobra.Command{
+		Use:   "validate",
+		Short: "Validate the configuration and access to the cluster.",
+		Long: "Loads the configuration, checks the kubeconfig, verifies the RBAC permissions, confirms the service and port exist\n" +
+			"and prints the resolved targets. Exits with non zero code if any of the checks fails.",
+		Args: cobra.NoArgs,
+		Run:  runValidate,
+	}
+)
+
+func init() {
+	validateCmd.Flags().DurationVar(&discoveryTimeout, "discovery-timeout", discoveryTimeout, "How long to wait for the targets to be discovered.")
+	rootCmd.AddCommand(validateCmd)
+}
+
+// requiredAccess returns access to the resources needed by the configured discovery.
+func requiredAccess() []controller.ResourceAccess {
+	watch := []string{"list", "watch"}
+	var required []controller.ResourceAccess
+	if serviceName != "" || watchServices || watchRoutes {
+		required = append(required, controller.ResourceAccess{Resource: "endpoints", Verbs: watch})
+	}
+	if selector != "" || includeNotReady || includeTerminating {
+		required = append(required, controller.ResourceAccess{Resource: "pods", Verbs: watch})
+	}
+	if watchServices || includeTerminating {
+		required = append(required, controller.ResourceAccess{Resource: "services", Verbs: watch})
+	}
+	if watchRoutes {
+		required = append(required,
+			controller.ResourceAccess{Group: controller.BroadcastRouteResource.Group, Resource: controller.BroadcastRouteResource.Resource, Verbs: watch},
+			controller.ResourceAccess{Group: controller.BroadcastRouteResource.Group, Resource: controller.BroadcastRouteResource.Resource, Subresource: "status", Verbs: []string{"get", "update"}},
+		)
+	}
+	if resolveZones {
+		required = append(required, controller.ResourceAccess{Resource: "nodes", Verbs: watch, ClusterScoped: true})
+	}
+	return required
+}
+
+// checkReviewAccess returns error if the broadcaster cannot create the reviews needed to authenticate or authorize the requests.
+func checkReviewAccess(access controller.ResourceAccess) error {
+	clientset, err := localClientset()
+	if err != nil {
+		return err
+	}
+	access.Verbs = []string{"create"}
+	access.ClusterScoped = true
+	return controller.CheckAccess(clientset, "", access)
+}
+
+func runValidate(cmd *cobra.Command, _ []string) {
+	out := cmd.OutOrStdout()
+	failed := false
+	report := func(err error, format string, args ...interface{}) {
+		if err != nil {
+			failed = true
+			_, _ = fmt.Fprintf(out, "FAIL  %v: %v\n", fmt.Sprintf(format, args...), err)
+			return
+		}
+		_, _ = fmt.Fprintf(out, "OK    %v\n", fmt.Sprintf(format, args...))
+	}
+
+	chain, err := newHandlerChain()
+	report(err, "configuration")
+	if chain != nil && chain.authMethods[auth.MethodTokenReview] {
+		report(checkReviewAccess(controller.ResourceAccess{Group: "authentication.k8s.io", Resource: "tokenreviews"}), "access to tokenreviews")
+	}
+	if chain != nil && chain.authorized {
+		report(checkReviewAccess(controller.ResourceAccess{Group: "authorization.k8s.io", Resource: "subjectaccessreviews"}), "access to subjectaccessreviews")
+	}
+	if usesKubernetes() {
+		err := loadKubeconfigs()
+		report(err, "kubeconfig")
+		for cluster, config := range kubeconfigs {
+			clientset, err := kubernetes.NewForConfig(config)
+			if err != nil {
+				report(err, "client of cluster %q", cluster)
+				continue
+			}
+			for _, namespace := range watchedNamespaces() {
+				for _, access := range requiredAccess() {
+					report(controller.CheckAccess(clientset, namespace, access), "access to %v in namespace %q of cluster %q", access.Resource, namespace, cluster)
+				}
+				if serviceName != "" {
+					report(controller.CheckServicePort(clientset, namespace, serviceName, port), "service %v with port %q in namespace %q of cluster %q", serviceName, port, namespace, cluster)
+				}
+			}
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+
+	discoverer, err := newDiscoverer()
+	if err != nil {
+		report(err, "targets discovery")
+		os.Exit(1)
+	}
+	if discoverer == nil {
+		_, _ = fmt.Fprintln(out, "No default targets, all targets are discovered from the watched resources.")
+		return
+	}
+	update, err := discoverTargets(discoverer, discoveryTimeout)
+	if err == nil {
+		err = update.Err
+	}
+	if err == nil && len(update.Targets) == 0 {
+		err = fmt.Errorf("no targets found")
+	}
+	report(err, "discovered %d targets", len(update.Targets))
+	printTargets(out, update.Targets)
+	if failed {
+		os.Exit(1)
+	}
+}
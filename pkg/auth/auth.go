@@ -0,0 +1,87 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Method is a way of authenticating the incoming requests.
+type Method string
+
+const (
+	// MethodNone allows anonymous requests.
+	MethodNone Method = "none"
+	// MethodStaticToken authenticates bearer tokens listed in a file.
+	MethodStaticToken Method = "static-token"
+	// MethodBasic authenticates HTTP basic credentials against a htpasswd file.
+	MethodBasic Method = "basic"
+	// MethodTokenReview authenticates bearer tokens, e.g. of service accounts, by the Kubernetes TokenReview API.
+	MethodTokenReview Method = "token-review"
+)
+
+// ParseMethod parses the authentication method from string.
+func ParseMethod(method string) (Method, error) {
+	switch m := Method(method); m {
+	case MethodNone, MethodStaticToken, MethodBasic, MethodTokenReview:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown authentication method %v, supported are %v, %v, %v and %v", method, MethodNone, MethodStaticToken, MethodBasic, MethodTokenReview)
+}
+
+// ParseMethods parses list of the authentication methods, none cannot be combined with other methods.
+func ParseMethods(methods []string) ([]Method, error) {
+	var parsed []Method
+	for _, m := range methods {
+		method, err := ParseMethod(m)
+		if err != nil {
+			return nil, err
+		}
+		parsed = append(parsed, method)
+	}
+	if len(parsed) > 1 {
+		for _, m := range parsed {
+			if m == MethodNone {
+				return nil, fmt.Errorf("authentication method %v cannot be combined with other methods", MethodNone)
+			}
+		}
+	}
+	return parsed, nil
+}
+
+// UserInfo is the authenticated user.
+type UserInfo struct {
+	Name   string
+	UID    string
+	Groups []string
+}
+
+// Authenticator verifies credentials of the incoming requests.
+type Authenticator interface {
+	// Authenticate returns the user if the request has valid credentials, nil user and nil error if it has no
+	// credentials this authenticator understands and error if the credentials are invalid or cannot be verified.
+	Authenticate(req *http.Request) (*UserInfo, error)
+}
+
+// bearerToken returns the token from the Authorization header of the request.
+func bearerToken(req *http.Request) (string, bool) {
+	parts := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return "", false
+	}
+	token := strings.TrimSpace(parts[1])
+	return token, token != ""
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// cache keeps the results of expensive verifications for the ttl, disabled if the ttl is 0.
+type cache struct {
+	ttl         time.Duration
+	entries     map[string]cacheEntry
+	entriesMtx  sync.Mutex
+	lastCleanup time.Time
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+func newCache(ttl time.Duration) *cache {
+	return &cache{
+		ttl:         ttl,
+		entries:     map[string]cacheEntry{},
+		entriesMtx:  sync.Mutex{},
+		lastCleanup: time.Now(),
+	}
+}
+
+func (c *cache) get(key string) (interface{}, bool) {
+	if c.ttl <= 0 {
+		return nil, false
+	}
+	c.entriesMtx.Lock()
+	defer c.entriesMtx.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (c *cache) set(key string, value interface{}) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.entriesMtx.Lock()
+	defer c.entriesMtx.Unlock()
+	now := time.Now()
+	// Drop the expired entries from time to time so the cache does not grow with every seen credential.
+	if now.Sub(c.lastCleanup) > c.ttl {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastCleanup = now
+	}
+	c.entries[key] = cacheEntry{value: value, expires: now.Add(c.ttl)}
+}
+
+// hashKey returns key of the cache not keeping the credentials in the memory in plain text.
+func hashKey(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		_, _ = h.Write([]byte(p))
+		_, _ = h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
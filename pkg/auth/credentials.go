@@ -0,0 +1,115 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ServiceAccountTokenFile is the token of the service account of the pod.
+	ServiceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// Credentials are set to the requests sent to the targets.
+type Credentials interface {
+	// Apply sets the credentials to the request replacing the Authorization header.
+	Apply(req *http.Request)
+}
+
+// NewTokenFileCredentials sends bearer token read from the file, the file is re-read after the refresh to pick up the rotated token.
+func NewTokenFileCredentials(path string, refresh time.Duration) (*tokenFileCredentials, error) {
+	token, err := newSecretFile(path, refresh)
+	if err != nil {
+		return nil, err
+	}
+	return &tokenFileCredentials{token: token}, nil
+}
+
+type tokenFileCredentials struct {
+	token *secretFile
+}
+
+func (c *tokenFileCredentials) Apply(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+c.token.value())
+}
+
+// NewBasicCredentials sends the user and password read from the file by HTTP basic authentication,
+// the file is re-read after the refresh to pick up the rotated password.
+func NewBasicCredentials(user, passwordPath string, refresh time.Duration) (*basicCredentials, error) {
+	password, err := newSecretFile(passwordPath, refresh)
+	if err != nil {
+		return nil, err
+	}
+	return &basicCredentials{user: user, password: password}, nil
+}
+
+type basicCredentials struct {
+	user     string
+	password *secretFile
+}
+
+func (c *basicCredentials) Apply(req *http.Request) {
+	req.SetBasicAuth(c.user, c.password.value())
+}
+
+// secretFile is content of the file re-read after the refresh, on failure the last read value is kept.
+type secretFile struct {
+	path    string
+	refresh time.Duration
+	content string
+	readAt  time.Time
+	mtx     sync.Mutex
+}
+
+func newSecretFile(path string, refresh time.Duration) (*secretFile, error) {
+	f := &secretFile{path: path, refresh: refresh}
+	if err := f.read(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *secretFile) read() error {
+	content, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	value := strings.TrimSpace(string(content))
+	if value == "" {
+		return fmt.Errorf("file %v is empty", f.path)
+	}
+	f.content = value
+	f.readAt = time.Now()
+	return nil
+}
+
+func (f *secretFile) value() string {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if time.Since(f.readAt) > f.refresh {
+		if err := f.read(); err != nil {
+			log.Errorf("Failed to re-read %v, keeping the previous value: %v", f.path, err)
+			// Do not try to read it with every request.
+			f.readAt = time.Now()
+		}
+	}
+	return f.content
+}
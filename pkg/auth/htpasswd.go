@@ -0,0 +1,78 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// NewHtpasswdAuthenticator loads users from the htpasswd file, only the bcrypt hashed passwords are supported.
+// Successful verifications are cached for the cacheTTL since the bcrypt is intentionally slow.
+func NewHtpasswdAuthenticator(path string, cacheTTL time.Duration) (*htpasswdAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	a := &htpasswdAuthenticator{hashes: map[string][]byte{}, verified: newCache(cacheTTL)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid line %d of htpasswd file %v, expected format is user:hash", line, path)
+		}
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return nil, fmt.Errorf("invalid hash of user %v in htpasswd file %v, only bcrypt is supported: %w", parts[0], path, err)
+		}
+		a.hashes[parts[0]] = []byte(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read htpasswd file %v: %w", path, err)
+	}
+	return a, nil
+}
+
+type htpasswdAuthenticator struct {
+	hashes   map[string][]byte
+	verified *cache
+}
+
+func (a *htpasswdAuthenticator) Authenticate(req *http.Request) (*UserInfo, error) {
+	name, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	hash, ok := a.hashes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown user %v", name)
+	}
+	key := hashKey(name, password)
+	if _, ok := a.verified.get(key); !ok {
+		if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+			return nil, fmt.Errorf("invalid password of user %v", name)
+		}
+		a.verified.set(key, true)
+	}
+	return &UserInfo{Name: name}, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes"
+	"strings"
+	"time"
+)
+
+// ResourceAttributes is the virtual resource and verb the users have to be allowed to access to send the requests,
+// e.g. verb broadcast on resource services.
+type ResourceAttributes struct {
+	Verb        string
+	Group       string
+	Resource    string
+	Subresource string
+}
+
+// Object is the object of the resource the request is sent to, empty name stands for all objects in the namespace
+// and empty namespace for all namespaces.
+type Object struct {
+	Namespace string
+	Name      string
+}
+
+func (o Object) String() string {
+	if o.Namespace == "" {
+		return o.Name
+	}
+	return o.Namespace + "/" + o.Name
+}
+
+// Authorizer decides if the authenticated user is allowed to send the request to the object.
+type Authorizer interface {
+	// Authorize returns false and reason if the user is not allowed and error if the access cannot be verified.
+	Authorize(user *UserInfo, object Object) (bool, string, error)
+}
+
+// NewSubjectAccessReviewAuthorizer authorizes the users by the Kubernetes SubjectAccessReview API
+// so the access is governed by the cluster RBAC. Decisions are cached for the cacheTTL.
+func NewSubjectAccessReviewAuthorizer(clientset kubernetes.Interface, attributes ResourceAttributes, cacheTTL time.Duration) *subjectAccessReviewAuthorizer {
+	return &subjectAccessReviewAuthorizer{
+		clientset:  clientset,
+		attributes: attributes,
+		decisions:  newCache(cacheTTL),
+	}
+}
+
+type subjectAccessReviewAuthorizer struct {
+	clientset  kubernetes.Interface
+	attributes ResourceAttributes
+	decisions  *cache
+}
+
+func (a *subjectAccessReviewAuthorizer) Authorize(user *UserInfo, object Object) (bool, string, error) {
+	key := hashKey(user.Name, user.UID, strings.Join(user.Groups, ","), object.Namespace, object.Name)
+	var status authorizationv1.SubjectAccessReviewStatus
+	if cached, ok := a.decisions.get(key); ok {
+		status = cached.(authorizationv1.SubjectAccessReviewStatus)
+	} else {
+		review, err := a.clientset.AuthorizationV1().SubjectAccessReviews().Create(&authorizationv1.SubjectAccessReview{
+			Spec: authorizationv1.SubjectAccessReviewSpec{
+				User:   user.Name,
+				UID:    user.UID,
+				Groups: user.Groups,
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   object.Namespace,
+					Verb:        a.attributes.Verb,
+					Group:       a.attributes.Group,
+					Resource:    a.attributes.Resource,
+					Subresource: a.attributes.Subresource,
+					Name:        object.Name,
+				},
+			},
+		})
+		if err != nil {
+			// Failures of the API are not cached so the access is verified again with the next request.
+			return false, "", fmt.Errorf("failed to review access: %w", err)
+		}
+		status = review.Status
+		a.decisions.set(key, status)
+	}
+	if !status.Allowed || status.Denied {
+		reason := status.Reason
+		if reason == "" {
+			reason = fmt.Sprintf("user %v cannot %v %v", user.Name, a.attributes.Verb, a.resource(object))
+		}
+		return false, reason, nil
+	}
+	return true, "", nil
+}
+
+// resource returns the human readable resource of the object, e.g. services/pushgateway in namespace monitoring.
+func (a *subjectAccessReviewAuthorizer) resource(object Object) string {
+	resource := a.attributes.Resource
+	if a.attributes.Group != "" {
+		resource += "." + a.attributes.Group
+	}
+	if object.Name != "" {
+		resource += "/" + object.Name
+	}
+	if a.attributes.Subresource != "" {
+		resource += "/" + a.attributes.Subresource
+	}
+	if object.Namespace != "" {
+		resource += " in namespace " + object.Namespace
+	}
+	return resource
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// NewTokenFileAuthenticator loads the static bearer tokens from the CSV file in the format token,user,uid,"group1,group2"
+// where the uid and groups are optional.
+func NewTokenFileAuthenticator(path string) (*tokenFileAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	r.TrimLeadingSpace = true
+	a := &tokenFileAuthenticator{tokens: map[string]*UserInfo{}}
+	for i := 1; ; i++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse token file %v: %w", path, err)
+		}
+		if len(record) < 2 || record[0] == "" || record[1] == "" {
+			return nil, fmt.Errorf("invalid record number %d of token file %v, expected at least token and user", i, path)
+		}
+		if _, ok := a.tokens[record[0]]; ok {
+			return nil, fmt.Errorf("duplicate token in record number %d of token file %v", i, path)
+		}
+		user := &UserInfo{Name: record[1]}
+		if len(record) > 2 {
+			user.UID = record[2]
+		}
+		if len(record) > 3 && record[3] != "" {
+			user.Groups = strings.Split(record[3], ",")
+		}
+		a.tokens[record[0]] = user
+	}
+	return a, nil
+}
+
+type tokenFileAuthenticator struct {
+	tokens map[string]*UserInfo
+}
+
+// Authenticate returns nil user for unknown tokens so they can be verified by other authenticators.
+func (a *tokenFileAuthenticator) Authenticate(req *http.Request) (*UserInfo, error) {
+	token, ok := bearerToken(req)
+	if !ok {
+		return nil, nil
+	}
+	return a.tokens[token], nil
+}
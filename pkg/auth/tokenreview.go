@@ -0,0 +1,68 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/client-go/kubernetes"
+	"net/http"
+	"time"
+)
+
+// NewTokenReviewAuthenticator verifies the bearer tokens by the Kubernetes TokenReview API.
+// If audiences are set, the token has to be issued for at least one of them.
+// Results of the reviews are cached for the cacheTTL.
+func NewTokenReviewAuthenticator(clientset kubernetes.Interface, audiences []string, cacheTTL time.Duration) *tokenReviewAuthenticator {
+	return &tokenReviewAuthenticator{
+		clientset: clientset,
+		audiences: audiences,
+		reviews:   newCache(cacheTTL),
+	}
+}
+
+type tokenReviewAuthenticator struct {
+	clientset kubernetes.Interface
+	audiences []string
+	reviews   *cache
+}
+
+func (a *tokenReviewAuthenticator) Authenticate(req *http.Request) (*UserInfo, error) {
+	token, ok := bearerToken(req)
+	if !ok {
+		return nil, nil
+	}
+	key := hashKey(token)
+	var status authenticationv1.TokenReviewStatus
+	if cached, ok := a.reviews.get(key); ok {
+		status = cached.(authenticationv1.TokenReviewStatus)
+	} else {
+		review, err := a.clientset.AuthenticationV1().TokenReviews().Create(&authenticationv1.TokenReview{
+			Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: a.audiences},
+		})
+		if err != nil {
+			// Failures of the API are not cached so the token is verified again with the next request.
+			return nil, fmt.Errorf("failed to review token: %w", err)
+		}
+		status = review.Status
+		a.reviews.set(key, status)
+	}
+	if !status.Authenticated {
+		if status.Error != "" {
+			return nil, fmt.Errorf("token not authenticated: %v", status.Error)
+		}
+		return nil, fmt.Errorf("token not authenticated")
+	}
+	return &UserInfo{Name: status.User.Username, UID: status.User.UID, Groups: status.User.Groups}, nil
+}
@@ -0,0 +1,244 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth_test
+
+import (
+	"github.com/fusakla/k8s-service-broadcasting/pkg/auth"
+	"github.com/magiconair/properties/assert"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newRequest(header string) *http.Request {
+	req, _ := http.NewRequest(http.MethodPost, "http://broadcaster/metrics", nil)
+	if header != "" {
+		req.Header.Set("Authorization", header)
+	}
+	return req
+}
+
+func TestParseMethods(t *testing.T) {
+	methods, err := auth.ParseMethods([]string{"static-token", "token-review"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, methods, []auth.Method{auth.MethodStaticToken, auth.MethodTokenReview})
+	for _, invalid := range [][]string{{"digest"}, {"none", "basic"}} {
+		if _, err := auth.ParseMethods(invalid); err == nil {
+			t.Errorf("expected error for methods %v", invalid)
+		}
+	}
+}
+
+func TestTokenFileAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeFile(t, dir, "tokens.csv", "# token,user,uid,groups\nsecret,ci,1,\"deployers,admins\"\nother,bob\n")
+	a, err := auth.NewTokenFileAuthenticator(path)
+	assert.Equal(t, err, nil)
+
+	user, err := a.Authenticate(newRequest("Bearer secret"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, *user, auth.UserInfo{Name: "ci", UID: "1", Groups: []string{"deployers", "admins"}})
+	user, err = a.Authenticate(newRequest("bearer other"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, user.Name, "bob")
+	for _, header := range []string{"", "Bearer unknown", "Basic c2VjcmV0"} {
+		user, err := a.Authenticate(newRequest(header))
+		assert.Equal(t, err, nil, header)
+		if user != nil {
+			t.Errorf("expected no user for header %q, got %v", header, user)
+		}
+	}
+
+	for _, content := range []string{"secret\n", "secret,ci\nsecret,bob\n"} {
+		if _, err := auth.NewTokenFileAuthenticator(writeFile(t, dir, "invalid.csv", content)); err == nil {
+			t.Errorf("expected error for token file %q", content)
+		}
+	}
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hash, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := auth.NewHtpasswdAuthenticator(writeFile(t, dir, "htpasswd", "# users\nalice:"+string(hash)+"\n"), time.Minute)
+	assert.Equal(t, err, nil)
+
+	for i := 0; i < 2; i++ {
+		req := newRequest("")
+		req.SetBasicAuth("alice", "pass")
+		user, err := a.Authenticate(req)
+		assert.Equal(t, err, nil)
+		assert.Equal(t, user.Name, "alice")
+	}
+	for _, credentials := range [][2]string{{"alice", "wrong"}, {"bob", "pass"}} {
+		req := newRequest("")
+		req.SetBasicAuth(credentials[0], credentials[1])
+		if _, err := a.Authenticate(req); err == nil {
+			t.Errorf("expected error for credentials %v", credentials)
+		}
+	}
+	user, err := a.Authenticate(newRequest("Bearer token"))
+	assert.Equal(t, err, nil)
+	if user != nil {
+		t.Errorf("expected no user for request without basic credentials, got %v", user)
+	}
+
+	if _, err := auth.NewHtpasswdAuthenticator(writeFile(t, dir, "md5", "alice:$apr1$salt$hash\n"), time.Minute); err == nil {
+		t.Error("expected error for not bcrypt hash")
+	}
+}
+
+func TestTokenReviewAuthenticator(t *testing.T) {
+	reviews := 0
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview)
+		assert.Equal(t, review.Spec.Audiences, []string{"broadcaster"})
+		if review.Spec.Token == "valid" {
+			review.Status.Authenticated = true
+			review.Status.User = authenticationv1.UserInfo{Username: "system:serviceaccount:monitoring:ci", Groups: []string{"system:serviceaccounts"}}
+		} else {
+			review.Status.Error = "invalid token"
+		}
+		return true, review, nil
+	})
+	a := auth.NewTokenReviewAuthenticator(clientset, []string{"broadcaster"}, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		user, err := a.Authenticate(newRequest("Bearer valid"))
+		assert.Equal(t, err, nil)
+		assert.Equal(t, user.Name, "system:serviceaccount:monitoring:ci")
+		assert.Equal(t, user.Groups, []string{"system:serviceaccounts"})
+	}
+	assert.Equal(t, reviews, 1, "cached review")
+
+	_, err := a.Authenticate(newRequest("Bearer invalid"))
+	assert.Equal(t, err.Error(), "token not authenticated: invalid token")
+	user, err := a.Authenticate(newRequest(""))
+	assert.Equal(t, err, nil)
+	if user != nil {
+		t.Errorf("expected no user for request without token, got %v", user)
+	}
+	assert.Equal(t, reviews, 2)
+}
+
+func TestSubjectAccessReviewAuthorizer(t *testing.T) {
+	reviews := 0
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		attributes := review.Spec.ResourceAttributes
+		assert.Equal(t, attributes.Verb, "broadcast")
+		assert.Equal(t, attributes.Resource, "services")
+		review.Status.Allowed = review.Spec.User == "ci" && attributes.Namespace == "monitoring" && attributes.Name == "pushgateway"
+		return true, review, nil
+	})
+	a := auth.NewSubjectAccessReviewAuthorizer(clientset, auth.ResourceAttributes{Verb: "broadcast", Resource: "services"}, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		allowed, _, err := a.Authorize(&auth.UserInfo{Name: "ci"}, auth.Object{Namespace: "monitoring", Name: "pushgateway"})
+		assert.Equal(t, err, nil)
+		assert.Equal(t, allowed, true)
+	}
+	assert.Equal(t, reviews, 1, "cached decision")
+
+	allowed, reason, err := a.Authorize(&auth.UserInfo{Name: "bob"}, auth.Object{Namespace: "monitoring", Name: "pushgateway"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, allowed, false)
+	assert.Equal(t, reason, "user bob cannot broadcast services/pushgateway in namespace monitoring")
+	allowed, _, err = a.Authorize(&auth.UserInfo{Name: "ci"}, auth.Object{Namespace: "default", Name: "pushgateway"})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, allowed, false)
+	assert.Equal(t, reviews, 3)
+}
+
+func TestTokenFileCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeFile(t, dir, "token", "first\n")
+	c, err := auth.NewTokenFileCredentials(path, 10*time.Millisecond)
+	assert.Equal(t, err, nil)
+
+	req := newRequest("Basic client")
+	c.Apply(req)
+	assert.Equal(t, req.Header.Get("Authorization"), "Bearer first")
+
+	writeFile(t, dir, "token", "rotated")
+	time.Sleep(20 * time.Millisecond)
+	c.Apply(req)
+	assert.Equal(t, req.Header.Get("Authorization"), "Bearer rotated")
+
+	// Failed re-read keeps the previous token.
+	assert.Equal(t, os.Remove(path), nil)
+	time.Sleep(20 * time.Millisecond)
+	c.Apply(req)
+	assert.Equal(t, req.Header.Get("Authorization"), "Bearer rotated")
+
+	if _, err := auth.NewTokenFileCredentials(path, time.Minute); err == nil {
+		t.Error("expected error for missing token file")
+	}
+}
+
+func TestBasicCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := auth.NewBasicCredentials("broadcaster", writeFile(t, dir, "password", "secret\n"), time.Minute)
+	assert.Equal(t, err, nil)
+
+	req := newRequest("Bearer client")
+	c.Apply(req)
+	user, password, ok := req.BasicAuth()
+	assert.Equal(t, ok, true)
+	assert.Equal(t, user, "broadcaster")
+	assert.Equal(t, password, "secret")
+
+	if _, err := auth.NewBasicCredentials("broadcaster", writeFile(t, dir, "empty", "\n"), time.Minute); err == nil {
+		t.Error("expected error for empty password file")
+	}
+}
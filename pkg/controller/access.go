@@ -0,0 +1,110 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ResourceAccess is access to resource needed by the discovery.
+type ResourceAccess struct {
+	Group         string
+	Resource      string
+	Subresource   string
+	Verbs         []string
+	ClusterScoped bool
+}
+
+// CheckAccess returns error if the current user is not allowed to access the resource in the namespace.
+func CheckAccess(clientset kubernetes.Interface, namespace string, access ResourceAccess) error {
+	if access.ClusterScoped {
+		namespace = ""
+	}
+	resource := access.Resource
+	if access.Subresource != "" {
+		resource += "/" + access.Subresource
+	}
+	for _, verb := range access.Verbs {
+		review, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(&authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace:   namespace,
+					Verb:        verb,
+					Group:       access.Group,
+					Resource:    access.Resource,
+					Subresource: access.Subresource,
+				},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to check permission to %v %v: %w", verb, resource, err)
+		}
+		if !review.Status.Allowed {
+			if review.Status.Reason != "" {
+				return fmt.Errorf("missing permission to %v %v: %v", verb, resource, review.Status.Reason)
+			}
+			return fmt.Errorf("missing permission to %v %v", verb, resource)
+		}
+	}
+	return nil
+}
+
+// CheckServicePort returns error if the service does not exist in the namespace or does not have the port.
+// Empty namespace stands for all namespaces. The port is matched in the same way as by the discovery.
+func CheckServicePort(clientset kubernetes.Interface, namespace, name, port string) error {
+	services, err := clientset.CoreV1().Services(namespace).List(metav1.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String()})
+	if err != nil {
+		return fmt.Errorf("failed to get service %v: %w", name, err)
+	}
+	if len(services.Items) == 0 {
+		return fmt.Errorf("service %v not found", name)
+	}
+	for _, svc := range services.Items {
+		for _, ports := range servicePorts(clientset, svc) {
+			if _, err := findEndpointPort(ports, port); err != nil {
+				name, ok := servicePortName(&svc, port)
+				if !ok {
+					return fmt.Errorf("service %v/%v: %w", svc.Namespace, svc.Name, err)
+				}
+				if _, err := findEndpointPort(ports, name); err != nil {
+					return fmt.Errorf("service %v/%v: %w", svc.Namespace, svc.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// servicePorts returns ports of the endpoint subsets of the service. If there are no endpoints,
+// the ports are derived from the service spec, numbers of the named target ports are not known then.
+func servicePorts(clientset kubernetes.Interface, svc v1.Service) [][]v1.EndpointPort {
+	endpoints, err := clientset.CoreV1().Endpoints(svc.Namespace).Get(svc.Name, metav1.GetOptions{})
+	if err == nil && len(endpoints.Subsets) > 0 {
+		var ports [][]v1.EndpointPort
+		for _, subset := range endpoints.Subsets {
+			ports = append(ports, subset.Ports)
+		}
+		return ports
+	}
+	var ports []v1.EndpointPort
+	for _, p := range svc.Spec.Ports {
+		ports = append(ports, v1.EndpointPort{Name: p.Name, Port: p.TargetPort.IntVal})
+	}
+	return [][]v1.EndpointPort{ports}
+}
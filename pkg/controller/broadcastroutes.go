@@ -0,0 +1,274 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// BroadcastRouteResource is the BroadcastRoute custom resource.
+var BroadcastRouteResource = schema.GroupVersionResource{Group: "broadcasting.fusakla.io", Version: "v1alpha1", Resource: "broadcastroutes"}
+
+// Conditions written to status of the BroadcastRoute.
+const (
+	// ConditionReconciled is true if the route is valid and configured in the broadcaster.
+	ConditionReconciled = "Reconciled"
+	// ConditionTargetsFound is true if there is at least one target of the route.
+	ConditionTargetsFound = "TargetsFound"
+)
+
+// BroadcastRoute configures route of the incoming requests to targets of the services.
+type BroadcastRoute struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BroadcastRouteSpec   `json:"spec"`
+	Status BroadcastRouteStatus `json:"status,omitempty"`
+}
+
+// BroadcastRouteSpec is the desired route, empty settings fall back to the broadcaster defaults.
+type BroadcastRouteSpec struct {
+	Match    BroadcastRouteMatch     `json:"match,omitempty"`
+	Services []BroadcastRouteService `json:"services"`
+	// Port is name or number of the service port or number of the endpoint port of the services.
+	Port          string `json:"port,omitempty"`
+	SuccessPolicy string `json:"successPolicy,omitempty"`
+	Mode          string `json:"mode,omitempty"`
+	HashHeader    string `json:"hashHeader,omitempty"`
+	Timeout       string `json:"timeout,omitempty"`
+	Retries       int    `json:"retries,omitempty"`
+}
+
+// BroadcastRouteMatch selects the requests sent to the services, all the specified matchers must match.
+type BroadcastRouteMatch struct {
+	Host       string            `json:"host,omitempty"`
+	PathPrefix string            `json:"pathPrefix,omitempty"`
+	Path       string            `json:"path,omitempty"`
+	Methods    []string          `json:"methods,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+}
+
+// BroadcastRouteService is service the requests are broadcasted to.
+type BroadcastRouteService struct {
+	Name string `json:"name"`
+	// Namespace defaults to namespace of the BroadcastRoute.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// BroadcastRouteStatus is observed state of the route written by the broadcaster.
+type BroadcastRouteStatus struct {
+	ObservedGeneration int64                     `json:"observedGeneration,omitempty"`
+	Targets            int                       `json:"targets"`
+	LastError          string                    `json:"lastError,omitempty"`
+	Conditions         []BroadcastRouteCondition `json:"conditions,omitempty"`
+}
+
+// BroadcastRouteCondition is state of single aspect of the route.
+type BroadcastRouteCondition struct {
+	Type               string      `json:"type"`
+	Status             string      `json:"status"`
+	Reason             string      `json:"reason,omitempty"`
+	Message            string      `json:"message,omitempty"`
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// Key returns unique identifier of the services and port of the route, it changes only if the targets could change.
+func (r BroadcastRoute) Key() string {
+	var services []string
+	for _, s := range r.Spec.Services {
+		namespace := s.Namespace
+		if namespace == "" {
+			namespace = r.Namespace
+		}
+		services = append(services, namespace+"/"+s.Name)
+	}
+	sort.Strings(services)
+	return fmt.Sprintf("%s/%s:%s=%s", r.Namespace, r.Name, r.Spec.Port, strings.Join(services, ","))
+}
+
+// SetCondition sets the condition, the transition time is updated only if its status changes.
+func (s *BroadcastRouteStatus) SetCondition(condition BroadcastRouteCondition) {
+	for i, c := range s.Conditions {
+		if c.Type != condition.Type {
+			continue
+		}
+		condition.LastTransitionTime = c.LastTransitionTime
+		if c.Status != condition.Status {
+			condition.LastTransitionTime = metav1.Now()
+		}
+		s.Conditions[i] = condition
+		return
+	}
+	condition.LastTransitionTime = metav1.Now()
+	s.Conditions = append(s.Conditions, condition)
+}
+
+// NewBroadcastRoutesController returns controller watching the BroadcastRoute resources.
+func NewBroadcastRoutesController(client dynamic.Interface, namespace *string) (*BroadcastRoutesController, error) {
+	var namespaceName string
+	if namespace != nil {
+		namespaceName = *namespace
+	}
+	informerFactory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(client, 0, namespaceName, nil)
+	informer := informerFactory.ForResource(BroadcastRouteResource)
+	controller := BroadcastRoutesController{
+		client:          client,
+		informer:        informer,
+		informerFactory: informerFactory,
+		stopChannel:     make(chan struct{}),
+	}
+	informer.Informer().AddEventHandler(&controller)
+	return &controller, nil
+}
+
+type BroadcastRoutesController struct {
+	client          dynamic.Interface
+	informer        informers.GenericInformer
+	informerFactory dynamicinformer.DynamicSharedInformerFactory
+	updatesChannel  chan<- []BroadcastRoute
+	updateMtx       sync.Mutex
+	lastRoutes      []BroadcastRoute
+	sent            bool
+	stopChannel     chan struct{}
+}
+
+// ListRoutes returns all the BroadcastRoutes sorted by namespace and name.
+// Resources which can not be parsed are skipped and logged.
+func (b *BroadcastRoutesController) ListRoutes() ([]BroadcastRoute, error) {
+	objects, err := b.informer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var routes []BroadcastRoute
+	for _, obj := range objects {
+		u, ok := obj.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		var route BroadcastRoute
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &route); err != nil {
+			log.Errorf("Skipping invalid BroadcastRoute %v/%v: %v", u.GetNamespace(), u.GetName(), err)
+			continue
+		}
+		routes = append(routes, route)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Namespace+"/"+routes[i].Name < routes[j].Namespace+"/"+routes[j].Name
+	})
+	return routes, nil
+}
+
+// UpdateStatus writes the status to the BroadcastRoute if it differs from the current one.
+func (b *BroadcastRoutesController) UpdateStatus(namespace, name string, update func(status *BroadcastRouteStatus)) error {
+	resource := b.client.Resource(BroadcastRouteResource).Namespace(namespace)
+	u, err := resource.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	var route BroadcastRoute
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &route); err != nil {
+		return err
+	}
+	original := route.Status
+	original.Conditions = append([]BroadcastRouteCondition{}, route.Status.Conditions...)
+	route.Status.ObservedGeneration = route.Generation
+	update(&route.Status)
+	if statusEqual(original, route.Status) {
+		return nil
+	}
+	status, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&route.Status)
+	if err != nil {
+		return err
+	}
+	u.Object["status"] = status
+	_, err = resource.UpdateStatus(u, metav1.UpdateOptions{})
+	return err
+}
+
+// statusEqual compares the statuses ignoring the transition times which change only together with the condition status.
+func statusEqual(a, b BroadcastRouteStatus) bool {
+	if a.ObservedGeneration != b.ObservedGeneration || a.Targets != b.Targets || a.LastError != b.LastError || len(a.Conditions) != len(b.Conditions) {
+		return false
+	}
+	for i := range a.Conditions {
+		ca, cb := a.Conditions[i], b.Conditions[i]
+		if ca.Type != cb.Type || ca.Status != cb.Status || ca.Reason != cb.Reason || ca.Message != cb.Message {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *BroadcastRoutesController) OnAdd(_ interface{}) {
+	// Until all the routes are listed, every added one would be reconciled with the partial list.
+	if !b.informer.Informer().HasSynced() {
+		return
+	}
+	b.update()
+}
+
+// update sends the current routes to the updates channel.
+func (b *BroadcastRoutesController) update() {
+	b.updateMtx.Lock()
+	defer b.updateMtx.Unlock()
+	routes, err := b.ListRoutes()
+	if err != nil {
+		log.Errorf("Failed to list BroadcastRoutes, error: %v", err)
+		return
+	}
+	// Every update is reconciled together with the status of all the routes, so the same routes are not sent again.
+	if b.sent && reflect.DeepEqual(routes, b.lastRoutes) {
+		return
+	}
+	b.lastRoutes, b.sent = routes, true
+	b.updatesChannel <- routes
+}
+
+func (b *BroadcastRoutesController) OnUpdate(_, newObj interface{}) {
+	b.OnAdd(newObj)
+}
+
+func (b *BroadcastRoutesController) OnDelete(obj interface{}) {
+	b.OnAdd(obj)
+}
+
+// Start starts watching the routes, every update contains full list of them.
+func (b *BroadcastRoutesController) Start(updatesChannel chan<- []BroadcastRoute) error {
+	b.updatesChannel = updatesChannel
+	b.informerFactory.Start(b.stopChannel)
+	go func() {
+		if cache.WaitForCacheSync(b.stopChannel, b.informer.Informer().HasSynced) {
+			b.update()
+		}
+	}()
+	return nil
+}
+
+func (b *BroadcastRoutesController) Stop() {
+	close(b.stopChannel)
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// NewCompositeDiscoverer returns discoverer merging targets of all the given discoverers.
+func NewCompositeDiscoverer(discoverers ...Discoverer) *CompositeDiscoverer {
+	return &CompositeDiscoverer{
+		discoverers: discoverers,
+		updates:     make([]*Update, len(discoverers)),
+		stopChannel: make(chan struct{}),
+	}
+}
+
+type CompositeDiscoverer struct {
+	discoverers    []Discoverer
+	started        []Discoverer
+	updates        []*Update
+	updatesMtx     sync.Mutex
+	updatesChannel chan<- Update
+	stopChannel    chan struct{}
+	stopOnce       sync.Once
+}
+
+// Start starts all the discoverers, if any of them fails to start the already started ones are stopped.
+func (c *CompositeDiscoverer) Start(updatesChannel chan<- Update) error {
+	c.updatesChannel = updatesChannel
+	for i, d := range c.discoverers {
+		childChannel := make(chan Update, 10)
+		go c.forward(i, childChannel)
+		if err := d.Start(childChannel); err != nil {
+			c.Stop()
+			return err
+		}
+		c.started = append(c.started, d)
+	}
+	return nil
+}
+
+// forward merges updates of the i-th discoverer with the last updates of the others.
+func (c *CompositeDiscoverer) forward(i int, childChannel chan Update) {
+	for {
+		select {
+		case <-c.stopChannel:
+			return
+		case update := <-childChannel:
+			c.updatesMtx.Lock()
+			c.updates[i] = &update
+			merged := Update{}
+			var errs []string
+			for _, u := range c.updates {
+				if u == nil {
+					continue
+				}
+				merged.Targets = append(merged.Targets, u.Targets...)
+				if u.Err != nil {
+					errs = append(errs, u.Err.Error())
+				}
+			}
+			if len(errs) > 0 {
+				merged.Err = fmt.Errorf("%s", strings.Join(errs, "; "))
+			}
+			// Send under the lock so the merged updates are not reordered.
+			select {
+			case c.updatesChannel <- merged:
+			case <-c.stopChannel:
+			}
+			c.updatesMtx.Unlock()
+		}
+	}
+}
+
+// Stop stops the started discoverers, the updates not read yet are dropped.
+func (c *CompositeDiscoverer) Stop() {
+	c.stopOnce.Do(func() {
+		for _, d := range c.started {
+			d.Stop()
+		}
+		close(c.stopChannel)
+	})
+}
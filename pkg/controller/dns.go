@@ -0,0 +1,143 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dnsLookupTimeout is the longest time a single resolution of the name can take, shorter refresh interval limits it further.
+const dnsLookupTimeout = 5 * time.Second
+
+// Resolver resolves the DNS records, it is satisfied by the net.Resolver.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+// NewDNSController returns discoverer periodically resolving the DNS name.
+// If srv is true, the name is SRV record providing also the ports, otherwise A/AAAA records are resolved and the numeric port is used.
+// This allows to use e.g. headless services without access to the Kubernetes API.
+func NewDNSController(resolver Resolver, name string, srv bool, port string, refreshInterval time.Duration) (*DNSController, error) {
+	controller := DNSController{
+		resolver:        resolver,
+		name:            name,
+		srv:             srv,
+		refreshInterval: refreshInterval,
+		lookupTimeout:   dnsLookupTimeout,
+		stopChannel:     make(chan struct{}),
+	}
+	if refreshInterval < controller.lookupTimeout {
+		controller.lookupTimeout = refreshInterval
+	}
+	if !srv {
+		portNumber, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("numeric port has to be specified for A/AAAA records, got %v", port)
+		}
+		controller.port = int32(portNumber)
+	}
+	return &controller, nil
+}
+
+type DNSController struct {
+	resolver        Resolver
+	name            string
+	srv             bool
+	port            int32
+	refreshInterval time.Duration
+	lookupTimeout   time.Duration
+	lastTargets     []Target
+	lastErr         error
+	updatesChannel  chan<- Update
+	stopChannel     chan struct{}
+}
+
+// ListMatchingIPs resolves the DNS name and returns the targets sorted by address.
+func (d *DNSController) ListMatchingIPs() (*[]Target, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.lookupTimeout)
+	defer cancel()
+	var targets []Target
+	if d.srv {
+		_, records, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			targets = append(targets, Target{Address: net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))), Port: int32(r.Port), Ready: true})
+		}
+	} else {
+		addrs, err := d.resolver.LookupIPAddr(ctx, d.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			targets = append(targets, Target{Address: net.JoinHostPort(a.IP.String(), strconv.Itoa(int(d.port))), Port: d.port, Ready: true})
+		}
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Address < targets[j].Address })
+	numberOfEndpoints.WithLabelValues("", "", d.name, "ready").Set(float64(len(targets)))
+	return &targets, nil
+}
+
+// refresh sends update only if the resolved targets changed, if the resolution fails the last targets are kept.
+func (d *DNSController) refresh() {
+	targets, err := d.ListMatchingIPs()
+	if err != nil {
+		log.Errorf("Failed to resolve %v, keeping the previous targets: %v", d.name, err)
+		if d.lastErr == nil {
+			d.updatesChannel <- Update{Targets: d.lastTargets, Err: err}
+		}
+		d.lastErr = err
+		return
+	}
+	if d.lastErr == nil && d.lastTargets != nil && reflect.DeepEqual(*targets, d.lastTargets) {
+		return
+	}
+	d.lastTargets = *targets
+	d.lastErr = nil
+	d.updatesChannel <- Update{Targets: *targets}
+}
+
+func (d *DNSController) watch() {
+	ticker := time.NewTicker(d.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stopChannel:
+			return
+		case <-ticker.C:
+			d.refresh()
+		}
+	}
+}
+
+func (d *DNSController) Start(updatesChannel chan<- Update) error {
+	d.updatesChannel = updatesChannel
+	d.refresh()
+	go d.watch()
+	return nil
+}
+
+func (d *DNSController) Stop() {
+	close(d.stopChannel)
+}
@@ -17,22 +17,27 @@ import (
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	listers "k8s.io/client-go/listers/core/v1"
-	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"reflect"
+	"strconv"
+	"sync"
 )
 
 var (
 	numberOfEndpoints = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "service_endpoint_count",
-			Help: "Number of found endpoints for given service.",
+			Help: "Number of found endpoints for given service by state (ready, not_ready, terminating).",
 		},
-		[]string{"service"},
+		[]string{"cluster", "namespace", "service", "state"},
 	)
 )
 
@@ -40,46 +45,196 @@ func init() {
 	prometheus.MustRegister(numberOfEndpoints)
 }
 
-func NewEndpointController(config *rest.Config, namespace *string, serviceName string, servicePortname string, updatesChannel chan *[]string) (*EndpointsController, error) {
+// NewEndpointController returns discoverer watching endpoints of the service, the cluster is name the targets are tagged with.
+// The servicePort is name of the service port or number of the endpoint port, i.e. the target port of the service,
+// number of the service port is resolved to its target port. It can be empty if the service has only single port.
+// Not ready and terminating endpoints are included only if enabled, distinguishing them requires access to the pods.
+// Terminating pods are removed from the endpoints, so they are found by selector of the service, this requires access to the services.
+// If resolveZones is set, the targets are tagged with zone of their node, this requires access to the nodes.
+func NewEndpointController(clientset kubernetes.Interface, cluster string, namespace *string, serviceName string, servicePort string, includeNotReady, includeTerminating, resolveZones bool) (*EndpointsController, error) {
 	var informerFactory informers.SharedInformerFactory
-	stopChannel := make(chan struct{})
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, err
-	}
 	var informerOptions []informers.SharedInformerOption
+	var namespaceName string
 	if namespace != nil {
+		namespaceName = *namespace
 		informerOptions = append(informerOptions, informers.WithNamespace(*namespace))
 	}
 	informerFactory = informers.NewSharedInformerFactoryWithOptions(clientset, 0, informerOptions...)
 	controller := EndpointsController{
+		namespace: namespaceName,
 		clientset: clientset,
 
-		informer:        informerFactory.Core().V1().Endpoints().Informer(),
-		lister:          informerFactory.Core().V1().Endpoints().Lister(),
-		serviceName:     serviceName,
-		servicePortName: servicePortname,
-		updatesChannel:  updatesChannel,
-		stopChannel:     stopChannel,
+		cluster:            cluster,
+		informer:           informerFactory.Core().V1().Endpoints().Informer(),
+		lister:             informerFactory.Core().V1().Endpoints().Lister(),
+		serviceName:        serviceName,
+		servicePort:        servicePort,
+		includeNotReady:    includeNotReady,
+		includeTerminating: includeTerminating,
+		informerFactory:    informerFactory,
+		stopChannel:        make(chan struct{}),
+	}
+	if includeNotReady || includeTerminating {
+		controller.podLister = informerFactory.Core().V1().Pods().Lister()
+		// Neither change of the pod labels nor deletion of the terminating pod changes the endpoints.
+		informerFactory.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldPod, oldOk := oldObj.(*v1.Pod)
+				pod, ok := newObj.(*v1.Pod)
+				if !ok || !oldOk {
+					return
+				}
+				if (includeTerminating && pod.DeletionTimestamp != nil) || !reflect.DeepEqual(oldPod.Labels, pod.Labels) {
+					controller.update()
+				}
+			},
+			DeleteFunc: func(_ interface{}) {
+				if includeTerminating {
+					controller.update()
+				}
+			},
+		})
+	}
+	if includeTerminating {
+		controller.serviceLister = informerFactory.Core().V1().Services().Lister()
+	}
+	if resolveZones {
+		controller.zones = newNodeZones(clientset, controller.update)
 	}
 	controller.informer.AddEventHandler(&controller)
-	informerFactory.Start(stopChannel)
 
 	return &controller, nil
 }
 
 type EndpointsController struct {
-	clientset       *kubernetes.Clientset
-	informer        cache.SharedIndexInformer
-	lister          listers.EndpointsLister
-	serviceName     string
-	servicePortName string
-	updatesChannel  chan *[]string
-	stopChannel     chan struct{}
+	clientset          kubernetes.Interface
+	cluster            string
+	namespace          string
+	informer           cache.SharedIndexInformer
+	lister             listers.EndpointsLister
+	podLister          listers.PodLister
+	serviceLister      listers.ServiceLister
+	zones              *nodeZones
+	serviceName        string
+	servicePort        string
+	includeNotReady    bool
+	includeTerminating bool
+	informerFactory    informers.SharedInformerFactory
+	updatesChannel     chan<- Update
+	updateMtx          sync.Mutex
+	stopChannel        chan struct{}
+}
+
+// addressPod returns the pod the address belongs to, nil if the pods are not watched or the pod is not known.
+func (e *EndpointsController) addressPod(addr v1.EndpointAddress) *v1.Pod {
+	if e.podLister == nil || addr.TargetRef == nil || addr.TargetRef.Kind != "Pod" {
+		return nil
+	}
+	pod, err := e.podLister.Pods(addr.TargetRef.Namespace).Get(addr.TargetRef.Name)
+	if err != nil {
+		log.Debugf("Failed to get pod %v/%v of address %v: %v", addr.TargetRef.Namespace, addr.TargetRef.Name, addr.IP, err)
+		return nil
+	}
+	return pod
+}
+
+// isTerminating returns true if the pod the address belongs to is being deleted.
+func (e *EndpointsController) isTerminating(addr v1.EndpointAddress) bool {
+	pod := e.addressPod(addr)
+	return pod != nil && pod.DeletionTimestamp != nil
+}
+
+func (e *EndpointsController) endpointTarget(namespace string, addr v1.EndpointAddress, port int32, ready bool) Target {
+	t := Target{
+		Address:   fmt.Sprintf("%s:%d", addr.IP, port),
+		Port:      port,
+		Cluster:   e.cluster,
+		Namespace: namespace,
+		Ready:     ready,
+	}
+	if addr.NodeName != nil {
+		t.Node = *addr.NodeName
+		t.Zone = e.zones.zone(t.Node)
+	}
+	if addr.TargetRef != nil && addr.TargetRef.Kind == "Pod" {
+		t.Pod = addr.TargetRef.Name
+	}
+	if pod := e.addressPod(addr); pod != nil {
+		t.Labels = pod.Labels
+	}
+	return t
+}
+
+// findEndpointPort returns number of the port matching given name or number.
+// The endpoint ports have names of the service ports, but numbers of the target ports.
+// If the port is empty, there has to be only single port.
+func findEndpointPort(ports []v1.EndpointPort, port string) (int32, error) {
+	if port == "" {
+		if len(ports) != 1 {
+			return 0, fmt.Errorf("port has to be specified for service with %d ports", len(ports))
+		}
+		return ports[0].Port, nil
+	}
+	number, err := strconv.Atoi(port)
+	for _, p := range ports {
+		if p.Name == port || (err == nil && p.Port == int32(number)) {
+			return p.Port, nil
+		}
+	}
+	return 0, fmt.Errorf("port %v not found", port)
+}
+
+// servicePortName returns name of the service port with the given number. The endpoints have only numbers
+// of the target ports, so the number of the service port has to be matched by its name.
+func servicePortName(svc *v1.Service, port string) (string, bool) {
+	number, err := strconv.Atoi(port)
+	if err != nil {
+		return "", false
+	}
+	for _, p := range svc.Spec.Ports {
+		if p.Port == int32(number) {
+			return p.Name, true
+		}
+	}
+	return "", false
+}
+
+// findPort returns number of the endpoint port. The number of the target port takes precedence,
+// other number is looked up in the ports of the service.
+func (e *EndpointsController) findPort(namespace string, ports []v1.EndpointPort) (int32, error) {
+	port, err := findEndpointPort(ports, e.servicePort)
+	if err == nil {
+		return port, nil
+	}
+	if _, convErr := strconv.Atoi(e.servicePort); convErr != nil {
+		return 0, err
+	}
+	svc, svcErr := e.service(namespace)
+	if svcErr != nil {
+		log.Debugf("Failed to get service %v/%v to resolve its port %v: %v", namespace, e.serviceName, e.servicePort, svcErr)
+		return 0, err
+	}
+	name, ok := servicePortName(svc, e.servicePort)
+	if !ok {
+		return 0, err
+	}
+	return findEndpointPort(ports, name)
+}
+
+// service returns the service in the namespace, it is got from the API if the services are not watched.
+func (e *EndpointsController) service(namespace string) (*v1.Service, error) {
+	if e.serviceLister != nil {
+		return e.serviceLister.Services(namespace).Get(e.serviceName)
+	}
+	return e.clientset.CoreV1().Services(namespace).Get(e.serviceName, metav1.GetOptions{})
 }
 
-func (e *EndpointsController) ListMatchingIPs() (*[]string, error) {
-	var ips []string
+// ListMatchingIPs returns targets of the service. If the port is not found in some of the endpoint subsets,
+// these are skipped and the error is returned together with the remaining targets.
+func (e *EndpointsController) ListMatchingIPs() (*[]Target, error) {
+	var targets []Target
+	var portErr error
+	counts := map[string]int{"ready": 0, "not_ready": 0, "terminating": 0}
 	endpoints, err := e.lister.List(labels.Set{}.AsSelector())
 	if err != nil {
 		return nil, err
@@ -88,25 +243,132 @@ func (e *EndpointsController) ListMatchingIPs() (*[]string, error) {
 		if endpoint.Name != e.serviceName {
 			continue
 		}
+		seen := map[string]bool{}
 		for _, subset := range endpoint.Subsets {
-			var targetPort int32
-			portFound := false
-			for _, port := range subset.Ports {
-				if port.Name == e.servicePortName {
-					targetPort = port.Port
-					portFound = true
-				}
-			}
-			if !portFound {
-				log.Errorf("Did not find specified port name %v in the service %v", e.servicePortName, endpoint.Name)
+			targetPort, err := e.findPort(endpoint.Namespace, subset.Ports)
+			if err != nil {
+				portErr = fmt.Errorf("skipping %d endpoints of service %v: %w", len(subset.Addresses)+len(subset.NotReadyAddresses), endpoint.Name, err)
+				log.Error(portErr)
+				continue
 			}
 			for _, addr := range subset.Addresses {
-				ips = append(ips, fmt.Sprintf("%s:%d", addr.IP, targetPort))
+				seen[addr.IP] = true
+				// Terminating pods are kept in the ready addresses if the service publishes not ready addresses,
+				// they are served as ready unless the terminating ones are included explicitly.
+				if e.includeTerminating && e.isTerminating(addr) {
+					counts["terminating"]++
+					if e.includeTerminating {
+						targets = append(targets, e.endpointTarget(endpoint.Namespace, addr, targetPort, false))
+					}
+					continue
+				}
+				counts["ready"]++
+				targets = append(targets, e.endpointTarget(endpoint.Namespace, addr, targetPort, true))
+			}
+			for _, addr := range subset.NotReadyAddresses {
+				seen[addr.IP] = true
+				state := "not_ready"
+				include := e.includeNotReady
+				if e.includeTerminating && e.isTerminating(addr) {
+					state = "terminating"
+					include = e.includeTerminating
+				}
+				counts[state]++
+				if include {
+					targets = append(targets, e.endpointTarget(endpoint.Namespace, addr, targetPort, false))
+				}
 			}
 		}
+		if e.serviceLister != nil {
+			terminating := e.terminatingTargets(endpoint.Namespace, seen)
+			counts["terminating"] += len(terminating)
+			targets = append(targets, terminating...)
+		}
+	}
+	for state, count := range counts {
+		numberOfEndpoints.WithLabelValues(e.cluster, e.namespace, e.serviceName, state).Set(float64(count))
+	}
+	return &targets, portErr
+}
+
+// terminatingTargets returns targets of the terminating pods of the service which were already removed from its endpoints.
+func (e *EndpointsController) terminatingTargets(namespace string, seen map[string]bool) []Target {
+	svc, err := e.serviceLister.Services(namespace).Get(e.serviceName)
+	if err != nil {
+		log.Debugf("Failed to get service %v/%v to find its terminating pods: %v", namespace, e.serviceName, err)
+		return nil
+	}
+	if len(svc.Spec.Selector) == 0 {
+		return nil
+	}
+	pods, err := e.podLister.Pods(namespace).List(labels.SelectorFromSet(svc.Spec.Selector))
+	if err != nil {
+		log.Errorf("Failed to list pods of service %v/%v: %v", namespace, e.serviceName, err)
+		return nil
+	}
+	var targets []Target
+	for _, pod := range pods {
+		if pod.DeletionTimestamp == nil || pod.Status.PodIP == "" || seen[pod.Status.PodIP] {
+			continue
+		}
+		port, err := findServicePodPort(svc, pod, e.servicePort)
+		if err != nil {
+			log.Warnf("Skipping terminating pod %v/%v: %v", pod.Namespace, pod.Name, err)
+			continue
+		}
+		targets = append(targets, Target{
+			Address:   fmt.Sprintf("%s:%d", pod.Status.PodIP, port),
+			Port:      port,
+			Cluster:   e.cluster,
+			Namespace: pod.Namespace,
+			Pod:       pod.Name,
+			Node:      pod.Spec.NodeName,
+			Zone:      e.zones.zone(pod.Spec.NodeName),
+			Labels:    pod.Labels,
+		})
+	}
+	return targets
+}
+
+// findServicePodPort returns number of the pod port the service port points to, selected in the same way as by findPort.
+func findServicePodPort(svc *v1.Service, pod *v1.Pod, port string) (int32, error) {
+	if number, err := strconv.Atoi(port); err == nil {
+		name, ok := servicePortName(svc, port)
+		if !ok || hasTargetPort(svc, int32(number)) {
+			return int32(number), nil
+		}
+		port = name
 	}
-	numberOfEndpoints.WithLabelValues(e.serviceName).Set(float64(len(ips)))
-	return &ips, nil
+	var ports []v1.EndpointPort
+	for _, p := range svc.Spec.Ports {
+		ports = append(ports, v1.EndpointPort{Name: p.Name})
+	}
+	if _, err := findEndpointPort(ports, port); err != nil {
+		return 0, err
+	}
+	for _, p := range svc.Spec.Ports {
+		if p.Name != port && port != "" {
+			continue
+		}
+		switch {
+		case p.TargetPort.Type == intstr.String:
+			return findContainerPort(pod, p.TargetPort.StrVal)
+		case p.TargetPort.IntVal != 0:
+			return p.TargetPort.IntVal, nil
+		}
+		return p.Port, nil
+	}
+	return 0, fmt.Errorf("port %v not found", port)
+}
+
+// hasTargetPort returns true if some port of the service has the number as its target port.
+func hasTargetPort(svc *v1.Service, number int32) bool {
+	for _, p := range svc.Spec.Ports {
+		if p.TargetPort.Type == intstr.Int && p.TargetPort.IntVal == number {
+			return true
+		}
+	}
+	return false
 }
 
 func (e *EndpointsController) OnAdd(obj interface{}) {
@@ -121,12 +383,19 @@ func (e *EndpointsController) OnAdd(obj interface{}) {
 		log.Debugf("Skipping non matching service: %v", objectName)
 		return
 	}
-	ips, err := e.ListMatchingIPs()
-	if err != nil {
+	e.update()
+}
+
+// update sends the current targets to the updates channel.
+func (e *EndpointsController) update() {
+	e.updateMtx.Lock()
+	defer e.updateMtx.Unlock()
+	targets, err := e.ListMatchingIPs()
+	if targets == nil {
 		log.Errorf("Failed to list endpoints, error: %v", err)
 		return
 	}
-	e.updatesChannel <- ips
+	e.updatesChannel <- Update{Targets: *targets, Err: err}
 }
 func (e *EndpointsController) OnUpdate(_, newObj interface{}) {
 	e.OnAdd(newObj)
@@ -136,7 +405,24 @@ func (e *EndpointsController) OnDelete(obj interface{}) {
 	e.OnAdd(obj)
 }
 
-func (e *EndpointsController) StopController() {
+func (e *EndpointsController) Start(updatesChannel chan<- Update) error {
+	e.updatesChannel = updatesChannel
+	e.zones.start(e.stopChannel)
+	e.informerFactory.Start(e.stopChannel)
+	if e.podLister != nil {
+		// State of the pods is not known until they are listed, so the endpoints listed before have to be updated.
+		go func() {
+			for _, synced := range e.informerFactory.WaitForCacheSync(e.stopChannel) {
+				if !synced {
+					return
+				}
+			}
+			e.update()
+		}()
+	}
+	return nil
+}
+
+func (e *EndpointsController) Stop() {
 	close(e.stopChannel)
-	//close(e.updatesChannel)
 }
@@ -0,0 +1,203 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"strconv"
+	"sync"
+)
+
+// NewPodController returns discoverer watching the ready pods matching the label selector, the cluster is name the targets are tagged with.
+// This allows to use workloads without a Service, e.g. headless StatefulSets.
+// The port is name or number of the container port, it can be empty if the pods have only single port.
+// If resolveZones is set, the targets are tagged with zone of their node, this requires access to the nodes.
+func NewPodController(clientset kubernetes.Interface, cluster string, namespace *string, selector string, port string, resolveZones bool) (*PodsController, error) {
+	var informerFactory informers.SharedInformerFactory
+	parsedSelector, err := labels.Parse(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label selector %v: %w", selector, err)
+	}
+	informerOptions := []informers.SharedInformerOption{
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = parsedSelector.String()
+		}),
+	}
+	var namespaceName string
+	if namespace != nil {
+		namespaceName = *namespace
+		informerOptions = append(informerOptions, informers.WithNamespace(*namespace))
+	}
+	informerFactory = informers.NewSharedInformerFactoryWithOptions(clientset, 0, informerOptions...)
+	controller := PodsController{
+		cluster:         cluster,
+		namespace:       namespaceName,
+		clientset:       clientset,
+		informer:        informerFactory.Core().V1().Pods().Informer(),
+		lister:          informerFactory.Core().V1().Pods().Lister(),
+		selector:        parsedSelector,
+		port:            port,
+		informerFactory: informerFactory,
+		stopChannel:     make(chan struct{}),
+	}
+	if resolveZones {
+		controller.zones = newNodeZones(clientset, controller.update)
+	}
+	controller.informer.AddEventHandler(&controller)
+
+	return &controller, nil
+}
+
+type PodsController struct {
+	cluster         string
+	namespace       string
+	clientset       kubernetes.Interface
+	informer        cache.SharedIndexInformer
+	lister          listers.PodLister
+	zones           *nodeZones
+	selector        labels.Selector
+	port            string
+	informerFactory informers.SharedInformerFactory
+	updatesChannel  chan<- Update
+	updateMtx       sync.Mutex
+	stopChannel     chan struct{}
+}
+
+func isPodReady(pod *v1.Pod) bool {
+	if pod.DeletionTimestamp != nil || pod.Status.PodIP == "" {
+		return false
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == v1.PodReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// findContainerPort returns number of the container port matching given name or number.
+// If the port is empty, the pod has to have only single port.
+func findContainerPort(pod *v1.Pod, port string) (int32, error) {
+	var ports []v1.ContainerPort
+	for _, c := range pod.Spec.Containers {
+		ports = append(ports, c.Ports...)
+	}
+	if port == "" {
+		if len(ports) != 1 {
+			return 0, fmt.Errorf("port has to be specified for pod with %d ports", len(ports))
+		}
+		return ports[0].ContainerPort, nil
+	}
+	number, err := strconv.Atoi(port)
+	if err == nil {
+		// Numeric port does not have to be declared in the pod spec.
+		return int32(number), nil
+	}
+	for _, p := range ports {
+		if p.Name == port {
+			return p.ContainerPort, nil
+		}
+	}
+	return 0, fmt.Errorf("port %v not found", port)
+}
+
+// ListMatchingIPs returns targets of the ready pods. If the port is not found in some of the pods,
+// these are skipped and the error is returned together with the remaining targets.
+func (p *PodsController) ListMatchingIPs() (*[]Target, error) {
+	var targets []Target
+	var portErr error
+	pods, err := p.lister.List(p.selector)
+	if err != nil {
+		return nil, err
+	}
+	notReady := 0
+	for _, pod := range pods {
+		if !isPodReady(pod) {
+			notReady++
+			continue
+		}
+		port, err := findContainerPort(pod, p.port)
+		if err != nil {
+			portErr = fmt.Errorf("skipping pod %v/%v: %w", pod.Namespace, pod.Name, err)
+			log.Error(portErr)
+			continue
+		}
+		targets = append(targets, Target{
+			Address:   fmt.Sprintf("%s:%d", pod.Status.PodIP, port),
+			Port:      port,
+			Cluster:   p.cluster,
+			Namespace: pod.Namespace,
+			Pod:       pod.Name,
+			Node:      pod.Spec.NodeName,
+			Zone:      p.zones.zone(pod.Spec.NodeName),
+			Labels:    pod.Labels,
+			Ready:     true,
+		})
+	}
+	numberOfEndpoints.WithLabelValues(p.cluster, p.namespace, p.selector.String(), "ready").Set(float64(len(targets)))
+	numberOfEndpoints.WithLabelValues(p.cluster, p.namespace, p.selector.String(), "not_ready").Set(float64(notReady))
+	return &targets, portErr
+}
+
+func (p *PodsController) OnAdd(_ interface{}) {
+	// Until all the pods are listed, the targets would be incomplete.
+	if !p.informer.HasSynced() {
+		return
+	}
+	p.update()
+}
+
+// update sends the current targets to the updates channel.
+func (p *PodsController) update() {
+	p.updateMtx.Lock()
+	defer p.updateMtx.Unlock()
+	targets, err := p.ListMatchingIPs()
+	if targets == nil {
+		log.Errorf("Failed to list pods, error: %v", err)
+		return
+	}
+	p.updatesChannel <- Update{Targets: *targets, Err: err}
+}
+
+func (p *PodsController) OnUpdate(_, newObj interface{}) {
+	p.OnAdd(newObj)
+}
+
+func (p *PodsController) OnDelete(obj interface{}) {
+	p.OnAdd(obj)
+}
+
+func (p *PodsController) Start(updatesChannel chan<- Update) error {
+	p.updatesChannel = updatesChannel
+	p.zones.start(p.stopChannel)
+	p.informerFactory.Start(p.stopChannel)
+	go func() {
+		if cache.WaitForCacheSync(p.stopChannel, p.informer.HasSynced) {
+			p.update()
+		}
+	}()
+	return nil
+}
+
+func (p *PodsController) Stop() {
+	close(p.stopChannel)
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Annotations of the Service configuring the broadcasting to it.
+const (
+	AnnotationEnabled       = "broadcasting.fusakla.io/enabled"
+	AnnotationPort          = "broadcasting.fusakla.io/port"
+	AnnotationSuccessPolicy = "broadcasting.fusakla.io/success-policy"
+	AnnotationTimeout       = "broadcasting.fusakla.io/timeout"
+	AnnotationMode          = "broadcasting.fusakla.io/mode"
+	AnnotationHashHeader    = "broadcasting.fusakla.io/hash-header"
+	AnnotationHost          = "broadcasting.fusakla.io/host"
+	AnnotationPathPrefix    = "broadcasting.fusakla.io/path-prefix"
+)
+
+// BroadcastService is Service enabled for broadcasting by the annotations with the settings read from them.
+// Empty settings should fall back to the defaults.
+type BroadcastService struct {
+	Cluster   string
+	Namespace string
+	Name      string
+	// Port is name or number of the service port or number of the endpoint port.
+	Port          string
+	SuccessPolicy string
+	Mode          string
+	HashHeader    string
+	Timeout       time.Duration
+	// Host of the requests to be sent to the service, defaults to <name>.<namespace> if no PathPrefix is set.
+	Host       string
+	PathPrefix string
+}
+
+// Key returns unique identifier of the service and its port.
+func (s BroadcastService) Key() string {
+	return strings.Join([]string{s.Cluster, s.Namespace, s.Name, s.Port}, "/")
+}
+
+// NewServicesController returns controller watching Services annotated with the AnnotationEnabled set to true,
+// the cluster is name the services are tagged with.
+func NewServicesController(clientset kubernetes.Interface, cluster string, namespace *string) (*ServicesController, error) {
+	var informerOptions []informers.SharedInformerOption
+	if namespace != nil {
+		informerOptions = append(informerOptions, informers.WithNamespace(*namespace))
+	}
+	informerFactory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informerOptions...)
+	controller := ServicesController{
+		cluster:         cluster,
+		informer:        informerFactory.Core().V1().Services().Informer(),
+		lister:          informerFactory.Core().V1().Services().Lister(),
+		informerFactory: informerFactory,
+		stopChannel:     make(chan struct{}),
+	}
+	controller.informer.AddEventHandler(&controller)
+	return &controller, nil
+}
+
+type ServicesController struct {
+	cluster         string
+	informer        cache.SharedIndexInformer
+	lister          listers.ServiceLister
+	informerFactory informers.SharedInformerFactory
+	updatesChannel  chan<- []BroadcastService
+	updateMtx       sync.Mutex
+	stopChannel     chan struct{}
+}
+
+// broadcastService reads the settings from annotations of the service.
+func broadcastService(cluster string, svc *v1.Service) (BroadcastService, error) {
+	annotations := svc.Annotations
+	s := BroadcastService{
+		Cluster:       cluster,
+		Namespace:     svc.Namespace,
+		Name:          svc.Name,
+		Port:          annotations[AnnotationPort],
+		SuccessPolicy: annotations[AnnotationSuccessPolicy],
+		Mode:          annotations[AnnotationMode],
+		HashHeader:    annotations[AnnotationHashHeader],
+		Host:          annotations[AnnotationHost],
+		PathPrefix:    annotations[AnnotationPathPrefix],
+	}
+	if timeout, ok := annotations[AnnotationTimeout]; ok {
+		var err error
+		if s.Timeout, err = time.ParseDuration(timeout); err != nil {
+			return BroadcastService{}, fmt.Errorf("invalid %v annotation %v: %w", AnnotationTimeout, timeout, err)
+		}
+	}
+	if s.Host == "" && s.PathPrefix == "" {
+		s.Host = svc.Name + "." + svc.Namespace
+	}
+	return s, nil
+}
+
+// ListServices returns the services enabled for broadcasting sorted by their key.
+// Services with invalid annotations are skipped and logged.
+func (s *ServicesController) ListServices() ([]BroadcastService, error) {
+	services, err := s.lister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	var broadcastServices []BroadcastService
+	for _, svc := range services {
+		if svc.Annotations[AnnotationEnabled] != "true" {
+			continue
+		}
+		bs, err := broadcastService(s.cluster, svc)
+		if err != nil {
+			log.Errorf("Skipping service %v/%v: %v", svc.Namespace, svc.Name, err)
+			continue
+		}
+		broadcastServices = append(broadcastServices, bs)
+	}
+	sort.Slice(broadcastServices, func(i, j int) bool {
+		return broadcastServices[i].Key() < broadcastServices[j].Key()
+	})
+	return broadcastServices, nil
+}
+
+func (s *ServicesController) OnAdd(_ interface{}) {
+	// Until all the services are listed, the backends of the missing ones would be removed.
+	if !s.informer.HasSynced() {
+		return
+	}
+	s.update()
+}
+
+// update sends the current services to the updates channel.
+func (s *ServicesController) update() {
+	s.updateMtx.Lock()
+	defer s.updateMtx.Unlock()
+	services, err := s.ListServices()
+	if err != nil {
+		log.Errorf("Failed to list services, error: %v", err)
+		return
+	}
+	s.updatesChannel <- services
+}
+
+func (s *ServicesController) OnUpdate(_, newObj interface{}) {
+	s.OnAdd(newObj)
+}
+
+func (s *ServicesController) OnDelete(obj interface{}) {
+	s.OnAdd(obj)
+}
+
+// Start starts watching the services, every update contains full list of the services enabled for broadcasting.
+func (s *ServicesController) Start(updatesChannel chan<- []BroadcastService) error {
+	s.updatesChannel = updatesChannel
+	s.informerFactory.Start(s.stopChannel)
+	go func() {
+		if cache.WaitForCacheSync(s.stopChannel, s.informer.HasSynced) {
+			s.update()
+		}
+	}()
+	return nil
+}
+
+func (s *ServicesController) Stop() {
+	close(s.stopChannel)
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"os"
+	"sigs.k8s.io/yaml"
+	"strconv"
+	"time"
+)
+
+func parseTargets(addresses []string) ([]Target, error) {
+	targets := make([]Target, 0, len(addresses))
+	for _, a := range addresses {
+		_, port, err := net.SplitHostPort(a)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target address %v: %w", a, err)
+		}
+		portNumber, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port of target address %v: %w", a, err)
+		}
+		targets = append(targets, Target{Address: a, Port: int32(portNumber), Ready: true})
+	}
+	return targets, nil
+}
+
+// NewStaticController returns discoverer of the fixed list of addresses in the host:port format.
+func NewStaticController(addresses []string) (*StaticController, error) {
+	targets, err := parseTargets(addresses)
+	if err != nil {
+		return nil, err
+	}
+	return &StaticController{targets: targets}, nil
+}
+
+type StaticController struct {
+	targets []Target
+}
+
+func (s *StaticController) Start(updatesChannel chan<- Update) error {
+	updatesChannel <- Update{Targets: s.targets}
+	return nil
+}
+
+func (s *StaticController) Stop() {}
+
+// TargetsFile is the content of the file with targets.
+type TargetsFile struct {
+	// Targets are addresses in the host:port format.
+	Targets []string `json:"targets"`
+}
+
+// NewFileController returns discoverer reading the targets from YAML or JSON file and reloading it whenever it changes.
+func NewFileController(path string, refreshInterval time.Duration) (*FileController, error) {
+	return &FileController{
+		path:            path,
+		refreshInterval: refreshInterval,
+		stopChannel:     make(chan struct{}),
+	}, nil
+}
+
+type FileController struct {
+	path            string
+	refreshInterval time.Duration
+	modTime         time.Time
+	size            int64
+	targets         []Target
+	updatesChannel  chan<- Update
+	stopChannel     chan struct{}
+}
+
+func (f *FileController) Start(updatesChannel chan<- Update) error {
+	f.updatesChannel = updatesChannel
+	if err := f.reload(); err != nil {
+		return err
+	}
+	go f.watch(f.refreshInterval)
+	return nil
+}
+
+func (f *FileController) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil
+	}
+	f.modTime = info.ModTime()
+	f.size = info.Size()
+	content, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	var file TargetsFile
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return fmt.Errorf("failed to parse targets file %v: %w", f.path, err)
+	}
+	targets, err := parseTargets(file.Targets)
+	if err != nil {
+		return fmt.Errorf("invalid targets file %v: %w", f.path, err)
+	}
+	log.Infof("Loaded %d targets from %v", len(targets), f.path)
+	f.targets = targets
+	f.updatesChannel <- Update{Targets: targets}
+	return nil
+}
+
+func (f *FileController) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stopChannel:
+			return
+		case <-ticker.C:
+			if err := f.reload(); err != nil {
+				log.Errorf("Failed to reload targets, keeping the previous ones: %v", err)
+				f.updatesChannel <- Update{Targets: f.targets, Err: err}
+			}
+		}
+	}
+}
+
+func (f *FileController) Stop() {
+	close(f.stopChannel)
+}
@@ -0,0 +1,54 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+// Target is single endpoint the requests are sent to. Only the Address is always set,
+// the rest of the metadata is filled in if known to the discoverer.
+type Target struct {
+	// Address in the host:port format.
+	Address   string
+	Port      int32
+	Cluster   string
+	Namespace string
+	Pod       string
+	Node      string
+	Zone      string
+	// Labels of the pod, known for the endpoints only if their pods are watched.
+	Labels map[string]string
+	// Ready is false for endpoints which are not ready yet or are terminating.
+	Ready bool
+}
+
+// Discoverer discovers the targets and sends updates of them once started until stopped.
+type Discoverer interface {
+	// Start starts the discovery, every update contains full list of the targets.
+	Start(updatesChannel chan<- Update) error
+	Stop()
+}
+
+// Update is sent by the discoverers whenever the targets change.
+type Update struct {
+	Targets []Target
+	// Err is set if some of the targets could not be resolved, the Targets contain only the valid ones.
+	Err error
+}
+
+// Addresses returns addresses of the targets.
+func Addresses(targets []Target) []string {
+	addresses := make([]string, 0, len(targets))
+	for _, t := range targets {
+		addresses = append(addresses, t.Address)
+	}
+	return addresses
+}
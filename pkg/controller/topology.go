@@ -0,0 +1,87 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller
+
+import (
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	zoneLabel       = "topology.kubernetes.io/zone"
+	legacyZoneLabel = "failure-domain.beta.kubernetes.io/zone"
+)
+
+// newNodeZones returns resolver of zones of the nodes, it needs separate informer since the nodes are not namespaced.
+// The onChange is called when zone of any of the nodes changes, e.g. the node got its zone label only after it joined.
+func newNodeZones(clientset kubernetes.Interface, onChange func()) *nodeZones {
+	informerFactory := informers.NewSharedInformerFactory(clientset, 0)
+	informerFactory.Core().V1().Nodes().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode, oldOk := oldObj.(*v1.Node)
+			node, ok := newObj.(*v1.Node)
+			if ok && oldOk && nodeZone(oldNode) != nodeZone(node) {
+				onChange()
+			}
+		},
+	})
+	return &nodeZones{
+		lister:          informerFactory.Core().V1().Nodes().Lister(),
+		informerFactory: informerFactory,
+	}
+}
+
+// nodeZones resolves zone of the node from its well known topology labels.
+type nodeZones struct {
+	lister          listers.NodeLister
+	informerFactory informers.SharedInformerFactory
+}
+
+// start starts watching the nodes and waits for the cache to be synced so the first targets already have zones.
+func (n *nodeZones) start(stopChannel chan struct{}) {
+	if n == nil {
+		return
+	}
+	n.informerFactory.Start(stopChannel)
+	n.informerFactory.WaitForCacheSync(stopChannel)
+}
+
+// zone returns zone of the node or empty string if not known.
+func (n *nodeZones) zone(nodeName string) string {
+	if n == nil || nodeName == "" {
+		return ""
+	}
+	node, err := n.lister.Get(nodeName)
+	if err != nil {
+		log.Debugf("Failed to get node %v to resolve its zone: %v", nodeName, err)
+		return ""
+	}
+	zone := nodeZone(node)
+	if zone == "" {
+		log.Debugf("Node %v has no zone label", nodeName)
+	}
+	return zone
+}
+
+// nodeZone returns zone of the node from its labels.
+func nodeZone(node *v1.Node) string {
+	if zone, ok := node.Labels[zoneLabel]; ok {
+		return zone
+	}
+	return node.Labels[legacyZoneLabel]
+}
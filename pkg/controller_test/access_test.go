@@ -0,0 +1,94 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller_test
+
+import (
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"github.com/magiconair/properties/assert"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"testing"
+)
+
+func TestCheckAccess(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+		attributes := review.Spec.ResourceAttributes
+		review.Status.Allowed = attributes.Namespace == "monitoring" && attributes.Resource == "endpoints" && attributes.Verb != "watch"
+		return true, review, nil
+	})
+	assert.Equal(t, controller.CheckAccess(clientset, "monitoring", controller.ResourceAccess{Resource: "endpoints", Verbs: []string{"get", "list"}}), nil)
+	err := controller.CheckAccess(clientset, "monitoring", controller.ResourceAccess{Resource: "endpoints", Verbs: []string{"list", "watch"}})
+	assert.Equal(t, err.Error(), "missing permission to watch endpoints")
+	if err := controller.CheckAccess(clientset, "default", controller.ResourceAccess{Resource: "endpoints", Verbs: []string{"list"}}); err == nil {
+		t.Error("expected missing permission in other namespace")
+	}
+}
+
+func TestCheckServicePort(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "pushgateway", Namespace: "monitoring"},
+			Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromInt(9091)},
+				{Name: "metrics", Port: 8081, TargetPort: intstr.FromString("metrics")},
+			}},
+		},
+	)
+	for _, port := range []string{"http", "9091", "metrics", "80", "8081"} {
+		assert.Equal(t, controller.CheckServicePort(clientset, "monitoring", "pushgateway", port), nil, port)
+	}
+	for _, port := range []string{"", "grpc", "9090"} {
+		if err := controller.CheckServicePort(clientset, "monitoring", "pushgateway", port); err == nil {
+			t.Errorf("expected error for port %q", port)
+		}
+	}
+	if err := controller.CheckServicePort(clientset, "default", "pushgateway", "http"); err == nil {
+		t.Error("expected error for service in other namespace")
+	}
+	err := controller.CheckServicePort(clientset, "monitoring", "pushgateway", "grpc")
+	assert.Equal(t, err.Error(), "service monitoring/pushgateway: port grpc not found")
+}
+
+func TestCheckServicePort_Endpoints(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "pushgateway", Namespace: "monitoring"},
+			Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromInt(9091)},
+				{Name: "metrics", Port: 8081, TargetPort: intstr.FromString("metrics")},
+			}},
+		},
+		&v1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "pushgateway", Namespace: "monitoring"},
+			Subsets: []v1.EndpointSubset{{
+				Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+				Ports:     []v1.EndpointPort{{Name: "http", Port: 9091}, {Name: "metrics", Port: 8082}},
+			}},
+		},
+	)
+	// Named target port is resolved by the endpoints.
+	for _, port := range []string{"http", "9091", "metrics", "8082", "80", "8081"} {
+		assert.Equal(t, controller.CheckServicePort(clientset, "monitoring", "pushgateway", port), nil, port)
+	}
+	if err := controller.CheckServicePort(clientset, "monitoring", "pushgateway", "8080"); err == nil {
+		t.Error("expected error for unknown port")
+	}
+}
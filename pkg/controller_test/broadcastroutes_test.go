@@ -0,0 +1,79 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller_test
+
+import (
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"github.com/magiconair/properties/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/fake"
+	"testing"
+	"time"
+)
+
+func testBroadcastRoute(name, service string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "broadcasting.fusakla.io/v1alpha1",
+		"kind":       "BroadcastRoute",
+		"metadata":   map[string]interface{}{"name": name, "namespace": "monitoring"},
+		"spec": map[string]interface{}{
+			"match":    map[string]interface{}{"pathPrefix": "/" + name},
+			"services": []interface{}{map[string]interface{}{"name": service}},
+			"port":     "http",
+		},
+	}}
+}
+
+func TestBroadcastRoutesController(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme(), testBroadcastRoute("pushgateway", "pushgateway"), testBroadcastRoute("alertmanager", "alertmanager"))
+	namespace := "monitoring"
+	c, err := controller.NewBroadcastRoutesController(client, &namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan []controller.BroadcastRoute, 10)
+	if err := c.Start(updates); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	var routes []controller.BroadcastRoute
+	select {
+	case routes = <-updates:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update received")
+	}
+	// The first update already contains all the routes.
+	assert.Equal(t, len(routes), 2)
+	assert.Equal(t, routes[0].Name, "alertmanager")
+	assert.Equal(t, routes[1].Spec.Services, []controller.BroadcastRouteService{{Name: "pushgateway"}})
+	select {
+	case routes = <-updates:
+		t.Fatalf("unexpected update with %d routes", len(routes))
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	err = c.UpdateStatus("monitoring", "pushgateway", func(status *controller.BroadcastRouteStatus) {
+		status.Targets = 2
+	})
+	assert.Equal(t, err, nil)
+	u, err := client.Resource(controller.BroadcastRouteResource).Namespace("monitoring").Get("pushgateway", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, _, _ := unstructured.NestedInt64(u.Object, "status", "targets")
+	assert.Equal(t, targets, int64(2))
+}
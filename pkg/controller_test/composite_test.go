@@ -0,0 +1,97 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller_test
+
+import (
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"github.com/magiconair/properties/assert"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCompositeDiscoverer(t *testing.T) {
+	first, err := controller.NewStaticController([]string{"10.0.0.1:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := controller.NewStaticController([]string{"10.0.0.2:80", "10.0.0.3:80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	composite := controller.NewCompositeDiscoverer(first, second)
+	updates := make(chan controller.Update, 10)
+	if err := composite.Start(updates); err != nil {
+		t.Fatal(err)
+	}
+	defer composite.Stop()
+
+	// Second update contains targets of both the discoverers.
+	<-updates
+	update := <-updates
+	assert.Equal(t, len(update.Targets), 3)
+	assert.Equal(t, update.Err, nil)
+}
+
+type stubDiscoverer struct {
+	updates  chan<- controller.Update
+	startErr error
+	stopped  bool
+}
+
+func (s *stubDiscoverer) Start(updatesChannel chan<- controller.Update) error {
+	s.updates = updatesChannel
+	return s.startErr
+}
+
+func (s *stubDiscoverer) Stop() {
+	s.stopped = true
+}
+
+func TestCompositeDiscoverer_StartError(t *testing.T) {
+	first, second, third := &stubDiscoverer{}, &stubDiscoverer{startErr: fmt.Errorf("no access")}, &stubDiscoverer{}
+	composite := controller.NewCompositeDiscoverer(first, second, third)
+	if err := composite.Start(make(chan controller.Update)); err == nil {
+		t.Fatal("expected error of the failed discoverer")
+	}
+	assert.Equal(t, first.stopped, true)
+	assert.Equal(t, third.stopped, false)
+	// Stopping again does not fail.
+	composite.Stop()
+}
+
+func TestCompositeDiscoverer_StopUnread(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	child := &stubDiscoverer{}
+	composite := controller.NewCompositeDiscoverer(child)
+	// Nobody reads the updates anymore, so the merged update cannot be sent.
+	if err := composite.Start(make(chan controller.Update)); err != nil {
+		t.Fatal(err)
+	}
+	child.updates <- controller.Update{}
+	composite.Stop()
+	for i := 0; i < 100 && runtime.NumGoroutine() > goroutines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, runtime.NumGoroutine() <= goroutines, true, "forwarding of the updates has to stop")
+}
+
+func TestNewStaticController_Invalid(t *testing.T) {
+	for _, addresses := range [][]string{{"10.0.0.1"}, {"10.0.0.1:http"}} {
+		if _, err := controller.NewStaticController(addresses); err == nil {
+			t.Errorf("expected error for addresses %v", addresses)
+		}
+	}
+}
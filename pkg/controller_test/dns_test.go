@@ -0,0 +1,131 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller_test
+
+import (
+	"context"
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"github.com/magiconair/properties/assert"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stubResolver struct {
+	ips  []net.IPAddr
+	srvs []*net.SRV
+	err  error
+	// timeout is the time left to the deadline of the last lookup.
+	timeout time.Duration
+	mtx     sync.Mutex
+}
+
+func (s *stubResolver) lookupTimeout() time.Duration {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.timeout
+}
+
+func (s *stubResolver) set(ips []net.IPAddr, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.ips = ips
+	s.err = err
+}
+
+func (s *stubResolver) LookupIPAddr(ctx context.Context, _ string) ([]net.IPAddr, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.timeout = time.Until(deadline)
+	}
+	return s.ips, s.err
+}
+
+func (s *stubResolver) LookupSRV(_ context.Context, _, _, _ string) (string, []*net.SRV, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return "", s.srvs, s.err
+}
+
+func TestDNSController_A(t *testing.T) {
+	resolver := &stubResolver{ips: []net.IPAddr{{IP: net.ParseIP("10.0.0.2")}, {IP: net.ParseIP("10.0.0.1")}}}
+	updates := make(chan controller.Update, 10)
+	c, err := controller.NewDNSController(resolver, "pushgateway.monitoring.svc", false, "9091", 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(updates); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	update := <-updates
+	assert.Equal(t, update.Err, nil)
+	assert.Equal(t, controller.Addresses(update.Targets), []string{"10.0.0.1:9091", "10.0.0.2:9091"})
+
+	// Failed resolution keeps the previous targets.
+	resolver.set(nil, fmt.Errorf("no such host"))
+	update = <-updates
+	assert.Equal(t, update.Err != nil, true)
+	assert.Equal(t, controller.Addresses(update.Targets), []string{"10.0.0.1:9091", "10.0.0.2:9091"})
+
+	resolver.set([]net.IPAddr{{IP: net.ParseIP("::1")}}, nil)
+	update = <-updates
+	assert.Equal(t, update.Err, nil)
+	assert.Equal(t, controller.Addresses(update.Targets), []string{"[::1]:9091"})
+}
+
+func TestDNSController_SRV(t *testing.T) {
+	resolver := &stubResolver{srvs: []*net.SRV{{Target: "pushgateway-0.pushgateway.monitoring.svc.", Port: 9091}}}
+	updates := make(chan controller.Update, 10)
+	c, err := controller.NewDNSController(resolver, "_http._tcp.pushgateway.monitoring.svc", true, "", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(updates); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	update := <-updates
+	assert.Equal(t, controller.Addresses(update.Targets), []string{"pushgateway-0.pushgateway.monitoring.svc:9091"})
+	assert.Equal(t, update.Targets[0].Port, int32(9091))
+}
+
+func TestDNSController_LookupTimeout(t *testing.T) {
+	for refreshInterval, maxTimeout := range map[time.Duration]time.Duration{time.Minute: 5 * time.Second, 100 * time.Millisecond: 100 * time.Millisecond} {
+		resolver := &stubResolver{ips: []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}}
+		updates := make(chan controller.Update, 10)
+		c, err := controller.NewDNSController(resolver, "pushgateway.monitoring.svc", false, "9091", refreshInterval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Start(updates); err != nil {
+			t.Fatal(err)
+		}
+		<-updates
+		c.Stop()
+		// Long refresh interval does not make the lookups hang for as long.
+		timeout := resolver.lookupTimeout()
+		assert.Equal(t, timeout > 0 && timeout <= maxTimeout, true, refreshInterval.String())
+	}
+}
+
+func TestDNSController_InvalidPort(t *testing.T) {
+	if _, err := controller.NewDNSController(&stubResolver{}, "foo", false, "http", time.Minute); err == nil {
+		t.Error("expected error for non numeric port")
+	}
+}
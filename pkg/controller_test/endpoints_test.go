@@ -0,0 +1,273 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller_test
+
+import (
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"github.com/magiconair/properties/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+// firstUpdate returns the first update of the discoverer.
+func firstUpdate(t *testing.T, discoverer controller.Discoverer) controller.Update {
+	updates := make(chan controller.Update, 10)
+	if err := discoverer.Start(updates); err != nil {
+		t.Fatal(err)
+	}
+	defer discoverer.Stop()
+	select {
+	case update := <-updates:
+		return update
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update received")
+	}
+	return controller.Update{}
+}
+
+func endpointsUpdate(t *testing.T, port string, objects ...runtime.Object) controller.Update {
+	namespace := "monitoring"
+	c, err := controller.NewEndpointController(fake.NewSimpleClientset(objects...), "", &namespace, "pushgateway", port, false, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return firstUpdate(t, c)
+}
+
+func TestEndpointsController_Port(t *testing.T) {
+	endpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "pushgateway", Namespace: "monitoring"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 9091}, {Name: "metrics", Port: 8081}},
+		}},
+	}
+	for _, port := range []string{"http", "9091"} {
+		update := endpointsUpdate(t, port, endpoints)
+		assert.Equal(t, update.Err, nil, port)
+		assert.Equal(t, controller.Addresses(update.Targets), []string{"10.0.0.1:9091"}, port)
+	}
+	// Number of the service port is not known without the service.
+	update := endpointsUpdate(t, "80", endpoints)
+	assert.Equal(t, update.Err.Error(), "skipping 1 endpoints of service pushgateway: port 80 not found")
+	assert.Equal(t, len(update.Targets), 0)
+}
+
+func TestEndpointsController_ServicePort(t *testing.T) {
+	service := &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "pushgateway", Namespace: "monitoring"},
+		Spec: v1.ServiceSpec{Ports: []v1.ServicePort{
+			{Name: "http", Port: 80, TargetPort: intstr.FromInt(9091)},
+			{Name: "metrics", Port: 9091, TargetPort: intstr.FromInt(8081)},
+		}},
+	}
+	endpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "pushgateway", Namespace: "monitoring"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 9091}, {Name: "metrics", Port: 8081}},
+		}},
+	}
+	// Number of the target port takes precedence over the same number of the service port.
+	for port, address := range map[string]string{"80": "10.0.0.1:9091", "9091": "10.0.0.1:9091", "8081": "10.0.0.1:8081"} {
+		update := endpointsUpdate(t, port, service, endpoints)
+		assert.Equal(t, update.Err, nil, port)
+		assert.Equal(t, controller.Addresses(update.Targets), []string{address}, port)
+	}
+	update := endpointsUpdate(t, "8080", service, endpoints)
+	assert.Equal(t, update.Err.Error(), "skipping 1 endpoints of service pushgateway: port 8080 not found")
+}
+
+func TestEndpointsController_PortFailClosed(t *testing.T) {
+	endpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "pushgateway", Namespace: "monitoring"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 9091}, {Name: "metrics", Port: 8081}},
+		}},
+	}
+	update := endpointsUpdate(t, "", endpoints)
+	assert.Equal(t, update.Err.Error(), "skipping 1 endpoints of service pushgateway: port has to be specified for service with 2 ports")
+	assert.Equal(t, len(update.Targets), 0)
+}
+
+func TestEndpointsController_UnnamedSinglePort(t *testing.T) {
+	endpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "pushgateway", Namespace: "monitoring"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses:         []v1.EndpointAddress{{IP: "10.0.0.1"}, {IP: "10.0.0.2"}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "10.0.0.3"}},
+			Ports:             []v1.EndpointPort{{Port: 9091}},
+		}},
+	}
+	update := endpointsUpdate(t, "", endpoints)
+	assert.Equal(t, update.Err, nil)
+	assert.Equal(t, controller.Addresses(update.Targets), []string{"10.0.0.1:9091", "10.0.0.2:9091"})
+}
+
+// waitForUpdate returns the first update of the discoverer matching the condition.
+func waitForUpdate(t *testing.T, discoverer controller.Discoverer, condition func(controller.Update) bool) controller.Update {
+	updates := make(chan controller.Update, 10)
+	if err := discoverer.Start(updates); err != nil {
+		t.Fatal(err)
+	}
+	defer discoverer.Stop()
+	return nextUpdate(t, updates, condition)
+}
+
+// nextUpdate returns the first update from the channel matching the condition.
+func nextUpdate(t *testing.T, updates <-chan controller.Update, condition func(controller.Update) bool) controller.Update {
+	var last controller.Update
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case last = <-updates:
+			if condition(last) {
+				return last
+			}
+		case <-timeout:
+			t.Fatalf("no matching update received, last one: %+v", last)
+			return last
+		}
+	}
+}
+
+// targetStates returns readiness of the targets by their address.
+func targetStates(targets []controller.Target) map[string]bool {
+	states := map[string]bool{}
+	for _, t := range targets {
+		states[t.Address] = t.Ready
+	}
+	return states
+}
+
+func TestEndpointsController_NotReady(t *testing.T) {
+	endpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "pushgateway", Namespace: "monitoring"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses:         []v1.EndpointAddress{{IP: "10.0.0.1"}},
+			NotReadyAddresses: []v1.EndpointAddress{{IP: "10.0.0.2"}},
+			Ports:             []v1.EndpointPort{{Name: "http", Port: 9091}},
+		}},
+	}
+	namespace := "monitoring"
+	c, err := controller.NewEndpointController(fake.NewSimpleClientset(endpoints), "", &namespace, "pushgateway", "http", true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := waitForUpdate(t, c, func(u controller.Update) bool { return len(u.Targets) == 2 })
+	assert.Equal(t, targetStates(update.Targets), map[string]bool{"10.0.0.1:9091": true, "10.0.0.2:9091": false})
+}
+
+func TestEndpointsController_Terminating(t *testing.T) {
+	deleted := metav1.Now()
+	podRef := func(name string) *v1.ObjectReference {
+		return &v1.ObjectReference{Kind: "Pod", Namespace: "monitoring", Name: name}
+	}
+	pod := func(name, ip string, deletionTimestamp *metav1.Time) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "monitoring", Labels: map[string]string{"app": "pushgateway"}, DeletionTimestamp: deletionTimestamp},
+			Spec:       v1.PodSpec{Containers: []v1.Container{{Ports: []v1.ContainerPort{{Name: "web", ContainerPort: 9091}}}}},
+			Status:     v1.PodStatus{PodIP: ip},
+		}
+	}
+	objects := []runtime.Object{
+		&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "pushgateway", Namespace: "monitoring"},
+			Spec: v1.ServiceSpec{
+				Selector: map[string]string{"app": "pushgateway"},
+				Ports:    []v1.ServicePort{{Name: "http", Port: 80, TargetPort: intstr.FromString("web")}},
+			},
+		},
+		&v1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "pushgateway", Namespace: "monitoring"},
+			Subsets: []v1.EndpointSubset{{
+				// Terminating pod is kept in the addresses if the service publishes not ready addresses.
+				Addresses: []v1.EndpointAddress{{IP: "10.0.0.1", TargetRef: podRef("pushgateway-0")}, {IP: "10.0.0.2", TargetRef: podRef("pushgateway-1")}},
+				Ports:     []v1.EndpointPort{{Name: "http", Port: 9091}},
+			}},
+		},
+		pod("pushgateway-0", "10.0.0.1", nil),
+		pod("pushgateway-1", "10.0.0.2", &deleted),
+		// Terminating pod already removed from the endpoints.
+		pod("pushgateway-2", "10.0.0.3", &deleted),
+	}
+	namespace := "monitoring"
+
+	clientset := fake.NewSimpleClientset(objects...)
+	c, err := controller.NewEndpointController(clientset, "", &namespace, "pushgateway", "http", false, true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan controller.Update, 10)
+	if err := c.Start(updates); err != nil {
+		t.Fatal(err)
+	}
+	update := nextUpdate(t, updates, func(u controller.Update) bool { return len(u.Targets) == 3 })
+	assert.Equal(t, update.Err, nil)
+	assert.Equal(t, targetStates(update.Targets), map[string]bool{"10.0.0.1:9091": true, "10.0.0.2:9091": false, "10.0.0.3:9091": false})
+	// Deletion of the pod does not change the endpoints.
+	if err := clientset.CoreV1().Pods("monitoring").Delete("pushgateway-2", &metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	update = nextUpdate(t, updates, func(u controller.Update) bool { return len(u.Targets) == 2 })
+	assert.Equal(t, targetStates(update.Targets), map[string]bool{"10.0.0.1:9091": true, "10.0.0.2:9091": false})
+	c.Stop()
+
+	// Without the terminating ones included, the ready addresses are served as by default.
+	for _, includeNotReady := range []bool{false, true} {
+		c, err = controller.NewEndpointController(fake.NewSimpleClientset(objects...), "", &namespace, "pushgateway", "http", includeNotReady, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		update = waitForUpdate(t, c, func(u controller.Update) bool { return len(u.Targets) == 2 })
+		assert.Equal(t, targetStates(update.Targets), map[string]bool{"10.0.0.1:9091": true, "10.0.0.2:9091": true})
+	}
+}
+
+func TestEndpointsController_Labels(t *testing.T) {
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pushgateway-0", Namespace: "monitoring", Labels: map[string]string{"app": "pushgateway"}}}
+	endpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "pushgateway", Namespace: "monitoring"},
+		Subsets: []v1.EndpointSubset{{
+			Addresses: []v1.EndpointAddress{{IP: "10.0.0.1", TargetRef: &v1.ObjectReference{Kind: "Pod", Namespace: "monitoring", Name: "pushgateway-0"}}},
+			Ports:     []v1.EndpointPort{{Name: "http", Port: 9091}},
+		}},
+	}
+	namespace := "monitoring"
+	clientset := fake.NewSimpleClientset(endpoints, pod)
+	c, err := controller.NewEndpointController(clientset, "", &namespace, "pushgateway", "http", true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan controller.Update, 10)
+	if err := c.Start(updates); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	update := nextUpdate(t, updates, func(u controller.Update) bool { return len(u.Targets) == 1 && u.Targets[0].Labels != nil })
+	assert.Equal(t, update.Targets[0].Labels, map[string]string{"app": "pushgateway"})
+
+	// Change of the labels is propagated even though the endpoints do not change.
+	pod.Labels = map[string]string{"app": "pushgateway", "version": "v2"}
+	if _, err := clientset.CoreV1().Pods("monitoring").Update(pod); err != nil {
+		t.Fatal(err)
+	}
+	nextUpdate(t, updates, func(u controller.Update) bool { return len(u.Targets) == 1 && u.Targets[0].Labels["version"] == "v2" })
+}
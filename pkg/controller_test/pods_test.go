@@ -0,0 +1,115 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller_test
+
+import (
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"github.com/magiconair/properties/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func testPod(name, ip string, ready bool, ports ...v1.ContainerPort) *v1.Pod {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "monitoring", Labels: map[string]string{"app": "pushgateway"}},
+		Spec:       v1.PodSpec{NodeName: "node-1", Containers: []v1.Container{{Ports: ports}}},
+		Status:     v1.PodStatus{PodIP: ip, Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: status}}},
+	}
+}
+
+func podsUpdate(t *testing.T, port string, objects ...runtime.Object) controller.Update {
+	namespace := "monitoring"
+	c, err := controller.NewPodController(fake.NewSimpleClientset(objects...), "", &namespace, "app=pushgateway", port, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return firstUpdate(t, c)
+}
+
+func TestPodsController_Readiness(t *testing.T) {
+	http := v1.ContainerPort{Name: "http", ContainerPort: 9091}
+	terminating := testPod("pushgateway-2", "10.0.0.3", true, http)
+	deleted := metav1.Now()
+	terminating.DeletionTimestamp = &deleted
+	other := testPod("prometheus-0", "10.0.0.5", true, http)
+	other.Labels = map[string]string{"app": "prometheus"}
+
+	update := podsUpdate(t, "http",
+		testPod("pushgateway-0", "10.0.0.1", true, http),
+		testPod("pushgateway-1", "10.0.0.2", false, http),
+		terminating,
+		testPod("pushgateway-3", "", true, http),
+		other,
+	)
+	assert.Equal(t, update.Err, nil)
+	assert.Equal(t, update.Targets, []controller.Target{{
+		Address:   "10.0.0.1:9091",
+		Port:      9091,
+		Namespace: "monitoring",
+		Pod:       "pushgateway-0",
+		Node:      "node-1",
+		Labels:    map[string]string{"app": "pushgateway"},
+		Ready:     true,
+	}})
+}
+
+func TestPodsController_Port(t *testing.T) {
+	ports := []v1.ContainerPort{{Name: "http", ContainerPort: 9091}, {Name: "metrics", ContainerPort: 8081}}
+	for port, address := range map[string]string{"http": "10.0.0.1:9091", "metrics": "10.0.0.1:8081", "8080": "10.0.0.1:8080"} {
+		update := podsUpdate(t, port, testPod("pushgateway-0", "10.0.0.1", true, ports...))
+		assert.Equal(t, update.Err, nil, port)
+		assert.Equal(t, controller.Addresses(update.Targets), []string{address}, port)
+	}
+
+	update := podsUpdate(t, "", testPod("pushgateway-0", "10.0.0.1", true, ports...))
+	assert.Equal(t, update.Err.Error(), "skipping pod monitoring/pushgateway-0: port has to be specified for pod with 2 ports")
+	assert.Equal(t, len(update.Targets), 0)
+	update = podsUpdate(t, "grpc", testPod("pushgateway-0", "10.0.0.1", true, ports...))
+	assert.Equal(t, update.Err.Error(), "skipping pod monitoring/pushgateway-0: port grpc not found")
+
+	update = podsUpdate(t, "", testPod("pushgateway-0", "10.0.0.1", true, ports[0]))
+	assert.Equal(t, update.Err, nil)
+	assert.Equal(t, controller.Addresses(update.Targets), []string{"10.0.0.1:9091"})
+}
+
+func TestPodsController_NodeZone(t *testing.T) {
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1"}}
+	clientset := fake.NewSimpleClientset(testPod("pushgateway-0", "10.0.0.1", true, v1.ContainerPort{Name: "http", ContainerPort: 9091}), node)
+	namespace := "monitoring"
+	c, err := controller.NewPodController(clientset, "", &namespace, "app=pushgateway", "http", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan controller.Update, 10)
+	if err := c.Start(updates); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	update := nextUpdate(t, updates, func(u controller.Update) bool { return len(u.Targets) == 1 })
+	assert.Equal(t, update.Targets[0].Zone, "")
+
+	// Zone label added to the node later is propagated even though the pods do not change.
+	node.Labels = map[string]string{"topology.kubernetes.io/zone": "eu-1a"}
+	if _, err := clientset.CoreV1().Nodes().Update(node); err != nil {
+		t.Fatal(err)
+	}
+	nextUpdate(t, updates, func(u controller.Update) bool { return len(u.Targets) == 1 && u.Targets[0].Zone == "eu-1a" })
+}
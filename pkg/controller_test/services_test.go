@@ -0,0 +1,124 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller_test
+
+import (
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"github.com/magiconair/properties/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+func testService(namespace, name string, annotations map[string]string) *v1.Service {
+	return &v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: annotations}}
+}
+
+// nextServices returns the first update from the channel with the given number of services.
+func nextServices(t *testing.T, updates <-chan []controller.BroadcastService, count int) []controller.BroadcastService {
+	var last []controller.BroadcastService
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case last = <-updates:
+			if len(last) == count {
+				return last
+			}
+		case <-timeout:
+			t.Fatalf("no matching update received, last one: %+v", last)
+			return last
+		}
+	}
+}
+
+func TestServicesController_Annotations(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		testService("monitoring", "pushgateway", map[string]string{
+			controller.AnnotationEnabled:       "true",
+			controller.AnnotationPort:          "http",
+			controller.AnnotationSuccessPolicy: "all",
+			controller.AnnotationTimeout:       "5s",
+			controller.AnnotationMode:          "hash",
+			controller.AnnotationHashHeader:    "X-Tenant",
+			controller.AnnotationHost:          "pushgateway.example.com",
+		}),
+		testService("monitoring", "alertmanager", map[string]string{
+			controller.AnnotationEnabled:    "true",
+			controller.AnnotationPathPrefix: "/alertmanager",
+		}),
+		testService("default", "grafana", map[string]string{controller.AnnotationEnabled: "true"}),
+		testService("default", "invalid", map[string]string{controller.AnnotationEnabled: "true", controller.AnnotationTimeout: "5"}),
+		testService("default", "disabled", map[string]string{controller.AnnotationEnabled: "false"}),
+		testService("default", "kubernetes", nil),
+	)
+	c, err := controller.NewServicesController(clientset, "eu", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan []controller.BroadcastService, 10)
+	if err := c.Start(updates); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+
+	assert.Equal(t, nextServices(t, updates, 3), []controller.BroadcastService{
+		{Cluster: "eu", Namespace: "default", Name: "grafana", Host: "grafana.default"},
+		{Cluster: "eu", Namespace: "monitoring", Name: "alertmanager", PathPrefix: "/alertmanager"},
+		{
+			Cluster:       "eu",
+			Namespace:     "monitoring",
+			Name:          "pushgateway",
+			Port:          "http",
+			SuccessPolicy: "all",
+			Mode:          "hash",
+			HashHeader:    "X-Tenant",
+			Timeout:       5 * time.Second,
+			Host:          "pushgateway.example.com",
+		},
+	})
+
+	// Fixing the annotation adds the service, disabling another one removes it.
+	if _, err := clientset.CoreV1().Services("default").Update(testService("default", "invalid", map[string]string{controller.AnnotationEnabled: "true", controller.AnnotationTimeout: "5s"})); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, nextServices(t, updates, 4), []controller.BroadcastService{
+		{Cluster: "eu", Namespace: "default", Name: "grafana", Host: "grafana.default"},
+		{Cluster: "eu", Namespace: "default", Name: "invalid", Timeout: 5 * time.Second, Host: "invalid.default"},
+		{Cluster: "eu", Namespace: "monitoring", Name: "alertmanager", PathPrefix: "/alertmanager"},
+		{Cluster: "eu", Namespace: "monitoring", Name: "pushgateway", Port: "http", SuccessPolicy: "all", Mode: "hash", HashHeader: "X-Tenant", Timeout: 5 * time.Second, Host: "pushgateway.example.com"},
+	})
+	if _, err := clientset.CoreV1().Services("default").Update(testService("default", "grafana", nil)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, nextServices(t, updates, 3)[0], controller.BroadcastService{Cluster: "eu", Namespace: "default", Name: "invalid", Timeout: 5 * time.Second, Host: "invalid.default"})
+}
+
+func TestServicesController_Namespace(t *testing.T) {
+	namespace := "monitoring"
+	c, err := controller.NewServicesController(fake.NewSimpleClientset(
+		testService("monitoring", "pushgateway", map[string]string{controller.AnnotationEnabled: "true"}),
+		testService("default", "grafana", map[string]string{controller.AnnotationEnabled: "true"}),
+	), "", &namespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan []controller.BroadcastService, 10)
+	if err := c.Start(updates); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	assert.Equal(t, nextServices(t, updates, 1), []controller.BroadcastService{{Namespace: "monitoring", Name: "pushgateway", Host: "pushgateway.monitoring"}})
+}
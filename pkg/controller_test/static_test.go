@@ -0,0 +1,77 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package controller_test
+
+import (
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"github.com/magiconair/properties/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileController_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "targets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "targets.yaml")
+	// The file is replaced at once so the controller does not read it half written.
+	write := func(content string) {
+		if err := ioutil.WriteFile(path+".tmp", []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("targets: [10.0.0.1:9091]\n")
+
+	c, err := controller.NewFileController(path, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan controller.Update, 10)
+	if err := c.Start(updates); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Stop()
+	update := nextUpdate(t, updates, func(controller.Update) bool { return true })
+	assert.Equal(t, update.Err, nil)
+	assert.Equal(t, controller.Addresses(update.Targets), []string{"10.0.0.1:9091"})
+
+	write("targets:\n  - 10.0.0.1:9091\n  - 10.0.0.2:9091\n")
+	update = nextUpdate(t, updates, func(controller.Update) bool { return true })
+	assert.Equal(t, update.Err, nil)
+	assert.Equal(t, controller.Addresses(update.Targets), []string{"10.0.0.1:9091", "10.0.0.2:9091"})
+
+	// Invalid file keeps the previous targets.
+	write("targets: [10.0.0.3]\n")
+	update = nextUpdate(t, updates, func(controller.Update) bool { return true })
+	assert.Equal(t, update.Err.Error(), "invalid targets file "+path+": invalid target address 10.0.0.3: address 10.0.0.3: missing port in address")
+	assert.Equal(t, controller.Addresses(update.Targets), []string{"10.0.0.1:9091", "10.0.0.2:9091"})
+}
+
+func TestFileController_Invalid(t *testing.T) {
+	c, err := controller.NewFileController(filepath.Join(os.TempDir(), "missing-targets.yaml"), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(make(chan controller.Update, 10)); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
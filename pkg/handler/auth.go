@@ -0,0 +1,146 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/auth"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"strings"
+)
+
+const authRealm = "k8s-service-broadcasting"
+
+var (
+	unauthenticatedRequestsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "unauthenticated_requests_total",
+			Help: "Number of requests rejected because of missing or invalid credentials.",
+		},
+	)
+	forbiddenRequestsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "forbidden_requests_total",
+			Help: "Number of requests of authenticated users rejected by the authorization.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(unauthenticatedRequestsTotal, forbiddenRequestsTotal)
+}
+
+// SetAuthentication sets the authenticators of the methods and the methods accepted for routes not specifying their own.
+// Requests are not authenticated if there are no methods or the only method is none.
+func (h *multiplexingHandler) SetAuthentication(authenticators map[auth.Method]auth.Authenticator, defaultMethods []auth.Method) {
+	h.authenticators = authenticators
+	h.authMethods = defaultMethods
+}
+
+// authenticate returns user authenticated by any of the methods of the route, nil user if the route allows anonymous requests
+// and error if none of the methods authenticated the request.
+func (h *multiplexingHandler) authenticate(req *http.Request, route Route) (*auth.UserInfo, error) {
+	if len(route.Auth) == 0 || (len(route.Auth) == 1 && route.Auth[0] == auth.MethodNone) {
+		return nil, nil
+	}
+	var errs []string
+	for _, m := range route.Auth {
+		authenticator, ok := h.authenticators[m]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%v: not configured", m))
+			continue
+		}
+		user, err := authenticator.Authenticate(req)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%v: %v", m, err))
+			continue
+		}
+		if user != nil {
+			return user, nil
+		}
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no credentials")
+	}
+	return nil, fmt.Errorf("%v", strings.Join(errs, ", "))
+}
+
+// SetAuthorization sets the authorizer of the authenticated users and the objects the requests are sent to for routes not specifying their own.
+// Anonymous requests allowed by the routes are not authorized.
+func (h *multiplexingHandler) SetAuthorization(authorizer auth.Authorizer, defaultObjects []auth.Object) {
+	h.authorizer = authorizer
+	h.authzObjects = defaultObjects
+}
+
+// authorize returns response rejecting the request if the user is not allowed to access all the objects of the route, nil if allowed.
+func (h *multiplexingHandler) authorize(user *auth.UserInfo, route Route, reqLog *log.Entry) *http.Response {
+	if h.authorizer == nil {
+		return nil
+	}
+	objects := route.Objects
+	if len(objects) == 0 {
+		// Without known objects the user has to be allowed to access all of them.
+		objects = []auth.Object{{}}
+	}
+	for _, object := range objects {
+		allowed, reason, err := h.authorizer.Authorize(user, object)
+		if err != nil {
+			reqLog.Errorf("failed to authorize request to %v: %v", object, err)
+			return newResponse(http.StatusServiceUnavailable, "authorization failed")
+		}
+		if !allowed {
+			reqLog.Infof("rejecting forbidden request to %v: %v", object, reason)
+			forbiddenRequestsTotal.Inc()
+			return newResponse(http.StatusForbidden, fmt.Sprintf("forbidden: %v", reason))
+		}
+	}
+	return nil
+}
+
+// SetBackendCredentials sets the credentials sent to the targets instead of the ones of the client.
+// If stripAuthorization is set, the Authorization header of the client is not sent to the targets.
+func (h *multiplexingHandler) SetBackendCredentials(credentials auth.Credentials, stripAuthorization bool) {
+	h.backendCredentials = credentials
+	h.stripAuthorization = stripAuthorization
+}
+
+// setBackendCredentials sets the backend credentials to the request sent to a target.
+func (h *multiplexingHandler) setBackendCredentials(req *http.Request) {
+	if h.stripAuthorization {
+		req.Header.Del("Authorization")
+	}
+	if h.backendCredentials != nil {
+		h.backendCredentials.Apply(req)
+	}
+}
+
+// unauthorizedResponse returns response challenging the client to authenticate by the methods.
+func unauthorizedResponse(methods []auth.Method) *http.Response {
+	resp := newResponse(http.StatusUnauthorized, "unauthorized")
+	resp.Header = http.Header{}
+	challenges := map[string]bool{}
+	for _, m := range methods {
+		challenge := fmt.Sprintf("Bearer realm=%q", authRealm)
+		if m == auth.MethodBasic {
+			challenge = fmt.Sprintf("Basic realm=%q", authRealm)
+		}
+		if !challenges[challenge] {
+			challenges[challenge] = true
+			resp.Header.Add("WWW-Authenticate", challenge)
+		}
+	}
+	return resp
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	log "github.com/sirupsen/logrus"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+func newBalancer() *balancer {
+	return &balancer{
+		inFlight:    map[string]int{},
+		inFlightMtx: sync.Mutex{},
+	}
+}
+
+// balancer picks single target for the unicast modes.
+type balancer struct {
+	counter     uint64
+	inFlight    map[string]int
+	inFlightMtx sync.Mutex
+}
+
+func (b *balancer) started(target string) {
+	b.inFlightMtx.Lock()
+	defer b.inFlightMtx.Unlock()
+	b.inFlight[target]++
+}
+
+func (b *balancer) finished(target string) {
+	b.inFlightMtx.Lock()
+	defer b.inFlightMtx.Unlock()
+	b.inFlight[target]--
+	if b.inFlight[target] <= 0 {
+		delete(b.inFlight, target)
+	}
+}
+
+func (b *balancer) roundRobin(targets []controller.Target) controller.Target {
+	return targets[atomic.AddUint64(&b.counter, 1)%uint64(len(targets))]
+}
+
+func (b *balancer) leastInFlight(targets []controller.Target) controller.Target {
+	b.inFlightMtx.Lock()
+	defer b.inFlightMtx.Unlock()
+	// Start at rotating offset so targets with the same count are used evenly.
+	offset := int(atomic.AddUint64(&b.counter, 1) % uint64(len(targets)))
+	picked := targets[offset]
+	for i := range targets {
+		t := targets[(offset+i)%len(targets)]
+		if b.inFlight[t.Address] < b.inFlight[picked.Address] {
+			picked = t
+		}
+	}
+	return picked
+}
+
+// consistentHash uses rendezvous hashing so only keys of removed targets are remapped.
+func (b *balancer) consistentHash(targets []controller.Target, key string) controller.Target {
+	var picked controller.Target
+	var highest uint64
+	for _, t := range targets {
+		hash := fnv.New64a()
+		_, _ = hash.Write([]byte(key))
+		_, _ = hash.Write([]byte(t.Address))
+		if score := hash.Sum64(); picked.Address == "" || score > highest {
+			picked = t
+			highest = score
+		}
+	}
+	return picked
+}
+
+func (b *balancer) pick(route Route, req *http.Request, targets []controller.Target) controller.Target {
+	switch route.Mode {
+	case ModeLeastInFlight:
+		return b.leastInFlight(targets)
+	case ModeConsistentHash:
+		if key := req.Header.Get(route.HashHeader); key != "" {
+			return b.consistentHash(targets, key)
+		}
+	}
+	return b.roundRobin(targets)
+}
+
+// unicastRequest sends the request to single target picked according to the route mode.
+// Returns nil if the request timed out.
+func (h *multiplexingHandler) unicastRequest(ctx context.Context, req *http.Request, route Route, targets []controller.Target, indexes map[string]int, reqLog *log.Entry) *http.Response {
+	if len(targets) == 0 {
+		return newResponse(http.StatusServiceUnavailable, "no endpoints to query")
+	}
+	target := h.balancer.pick(route, req, targets)
+	duplicate, err := h.targetRequest(ctx, req, route, target, indexes[target.Address])
+	if err != nil {
+		reqLog.Errorf("Failed to create request to target %v, error: %v", target.Address, err)
+		return newResponse(http.StatusInternalServerError, "failed to create request to the target")
+	}
+	reqLog = targetLog(reqLog, target)
+	reqLog.Debugf("sending request in %v mode to target=%v", route.Mode, target.Address)
+	resp := h.handleRequestWithRetries(target, duplicate, route.Retries, reqLog)
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil
+	}
+	if resp.StatusCode >= 400 {
+		logFailedResponse(reqLog, 1, resp)
+	}
+	return resp
+}
@@ -0,0 +1,224 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Header set on responses of requests short-circuited by the circuit breaker.
+const circuitBreakerHeader = "X-Circuit-Breaker"
+
+var (
+	circuitBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "circuit_breaker_state",
+			Help: "State of the target circuit breaker, 0 closed, 1 open, 2 half-open.",
+		},
+		[]string{"target"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(circuitBreakerState)
+}
+
+// BreakerConfig configures the per target circuit breakers.
+type BreakerConfig struct {
+	// FailureThreshold is number of consecutive failures which opens the circuit, disabled if 0.
+	FailureThreshold int
+	// OpenDuration is how long the circuit stays open before letting a probe request through.
+	OpenDuration time.Duration
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+type circuitBreaker struct {
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreakers(config BreakerConfig) *circuitBreakers {
+	return &circuitBreakers{
+		config:      config,
+		breakers:    map[string]*circuitBreaker{},
+		breakersMtx: sync.Mutex{},
+	}
+}
+
+type circuitBreakers struct {
+	config      BreakerConfig
+	breakers    map[string]*circuitBreaker
+	breakersMtx sync.Mutex
+}
+
+func (c *circuitBreakers) enabled() bool {
+	return c.config.FailureThreshold > 0
+}
+
+func (c *circuitBreakers) transition(target string, b *circuitBreaker, state breakerState) {
+	log.Infof("circuit breaker of target %v changed state from %v to %v", target, b.state, state)
+	b.state = state
+	circuitBreakerState.WithLabelValues(target).Set(float64(state))
+}
+
+// allow returns true if request to the target should be sent.
+func (c *circuitBreakers) allow(target string) bool {
+	if !c.enabled() {
+		return true
+	}
+	c.breakersMtx.Lock()
+	defer c.breakersMtx.Unlock()
+	b, ok := c.breakers[target]
+	if !ok {
+		return true
+	}
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < c.config.OpenDuration {
+			return false
+		}
+		c.transition(target, b, breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		// Only single probe request is allowed in the half-open state.
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// isOpen returns true if requests to the target would be short-circuited.
+func (c *circuitBreakers) isOpen(target string) bool {
+	if !c.enabled() {
+		return false
+	}
+	c.breakersMtx.Lock()
+	defer c.breakersMtx.Unlock()
+	b, ok := c.breakers[target]
+	return ok && b.state == breakerOpen && time.Since(b.openedAt) < c.config.OpenDuration
+}
+
+func (c *circuitBreakers) record(target string, success bool) {
+	if !c.enabled() {
+		return
+	}
+	c.breakersMtx.Lock()
+	defer c.breakersMtx.Unlock()
+	b, ok := c.breakers[target]
+	if !ok {
+		b = &circuitBreaker{}
+		c.breakers[target] = b
+		circuitBreakerState.WithLabelValues(target).Set(float64(breakerClosed))
+	}
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+	if success {
+		b.failures = 0
+		if b.state != breakerClosed {
+			c.transition(target, b, breakerClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= c.config.FailureThreshold) {
+		b.openedAt = time.Now()
+		c.transition(target, b, breakerOpen)
+	}
+}
+
+// release lets another probe request to the half-open target without recording result of the previous one.
+func (c *circuitBreakers) release(target string) {
+	if !c.enabled() {
+		return
+	}
+	c.breakersMtx.Lock()
+	defer c.breakersMtx.Unlock()
+	if b, ok := c.breakers[target]; ok && b.state == breakerHalfOpen {
+		b.probing = false
+	}
+}
+
+// available returns targets with circuit not open, if all of them are open returns all the targets.
+func (c *circuitBreakers) available(targets []controller.Target) []controller.Target {
+	if !c.enabled() {
+		return targets
+	}
+	var available []controller.Target
+	for _, t := range targets {
+		if !c.isOpen(t.Address) {
+			available = append(available, t)
+		}
+	}
+	if len(available) == 0 {
+		return targets
+	}
+	return available
+}
+
+// forget removes breakers of targets which are not present anymore.
+func (c *circuitBreakers) forget(targets []string) {
+	c.breakersMtx.Lock()
+	defer c.breakersMtx.Unlock()
+	current := map[string]bool{}
+	for _, t := range targets {
+		current[t] = true
+	}
+	for t := range c.breakers {
+		if !current[t] {
+			delete(c.breakers, t)
+			circuitBreakerState.DeleteLabelValues(t)
+		}
+	}
+}
+
+func shortCircuitedResponse(req *http.Request) *http.Response {
+	resp := newResponse(http.StatusServiceUnavailable, fmt.Sprintf("circuit breaker for target %v is open", req.URL.Host))
+	resp.Request = req
+	resp.Header = http.Header{circuitBreakerHeader: []string{breakerOpen.String()}}
+	return resp
+}
+
+func isShortCircuited(resp *http.Response) bool {
+	return resp.Header.Get(circuitBreakerHeader) != ""
+}
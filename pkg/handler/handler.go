@@ -17,6 +17,8 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/auth"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
 	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
@@ -38,69 +40,272 @@ var (
 		},
 		[]string{"type", "endpoint", "status_code"},
 	)
+	backendRequestDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "backend_request_duration_seconds",
+			Help: "Duration of HTTP requests sent to the single targets by their cluster and zone.",
+		},
+		[]string{"cluster", "zone", "status_code"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(requestDurationSeconds)
+	prometheus.MustRegister(backendRequestDurationSeconds)
 }
 
 func NewMultiplexingHandler(ownAddress string, timeout time.Duration, allMustSucceed, keepalive bool) *multiplexingHandler {
 	return &multiplexingHandler{
-		ownAddress:           ownAddress,
-		timeout:              timeout,
-		allMustSucceed:       allMustSucceed,
-		keepalive:            keepalive,
-		targetAddresses:      &[]string{},
-		targetAddressesMutex: sync.Mutex{},
+		ownAddress:     ownAddress,
+		timeout:        timeout,
+		allMustSucceed: allMustSucceed,
+		keepalive:      keepalive,
+		mode:           ModeBroadcast,
+		forwardedMode:  ForwardedAppend,
+		latencies:      newLatencyWindow(latencyWindowSize),
+		balancer:       newBalancer(),
+		breakers:       newCircuitBreakers(BreakerConfig{}),
+		targets:        []controller.Target{},
+		backends:       map[string][]controller.Target{},
+		targetsMutex:   sync.Mutex{},
 	}
 }
 
 type multiplexingHandler struct {
-	ownAddress           string
-	timeout              time.Duration
-	allMustSucceed       bool
-	keepalive            bool
-	targetAddresses      *[]string
-	targetAddressesMutex sync.Mutex
+	ownAddress         string
+	timeout            time.Duration
+	allMustSucceed     bool
+	successPolicy      SuccessPolicy
+	keepalive          bool
+	mode               Mode
+	hashHeader         string
+	hedgeDelay         time.Duration
+	hedgePercentile    float64
+	latencies          *latencyWindow
+	routes             []Route
+	routesMutex        sync.RWMutex
+	balancer           *balancer
+	breakers           *circuitBreakers
+	notReadyBestEffort bool
+	localZone          string
+	clusters           []string
+	authenticators     map[auth.Method]auth.Authenticator
+	authMethods        []auth.Method
+	authorizer         auth.Authorizer
+	authzObjects       []auth.Object
+	backendCredentials auth.Credentials
+	stripAuthorization bool
+	forwardedMode      ForwardedMode
+	requestHeaders     *HeaderRules
+	responseHeaders    *HeaderRules
+	rewrite            *Rewrite
+	targets            []controller.Target
+	backends           map[string][]controller.Target
+	targetsMutex       sync.Mutex
+}
+
+func (h *multiplexingHandler) GetTargets() []controller.Target {
+	h.targetsMutex.Lock()
+	defer h.targetsMutex.Unlock()
+	return h.targets
+}
+
+func (h *multiplexingHandler) SetTargets(targets []controller.Target) {
+	h.targetsMutex.Lock()
+	defer h.targetsMutex.Unlock()
+	h.targets = targets
+	h.forgetRemovedTargets()
 }
 
+// GetBackendTargets returns targets of the backend the routes can send the requests to.
+func (h *multiplexingHandler) GetBackendTargets(backend string) []controller.Target {
+	h.targetsMutex.Lock()
+	defer h.targetsMutex.Unlock()
+	return h.backends[backend]
+}
+
+// SetBackendTargets sets targets of the backend the routes can send the requests to instead of the default targets.
+func (h *multiplexingHandler) SetBackendTargets(backend string, targets []controller.Target) {
+	h.targetsMutex.Lock()
+	defer h.targetsMutex.Unlock()
+	h.backends[backend] = targets
+	h.forgetRemovedTargets()
+}
+
+// RemoveBackend removes the backend, routes pointing to it have no targets.
+func (h *multiplexingHandler) RemoveBackend(backend string) {
+	h.targetsMutex.Lock()
+	defer h.targetsMutex.Unlock()
+	delete(h.backends, backend)
+	h.forgetRemovedTargets()
+}
+
+// forgetRemovedTargets drops state of the targets which are not in the default targets nor any backend.
+// Has to be called with the targetsMutex locked.
+func (h *multiplexingHandler) forgetRemovedTargets() {
+	addresses := controller.Addresses(h.targets)
+	for _, targets := range h.backends {
+		addresses = append(addresses, controller.Addresses(targets)...)
+	}
+	h.breakers.forget(addresses)
+}
+
+// GetTargetAddresses returns addresses of all the targets including the not ready ones.
 func (h *multiplexingHandler) GetTargetAddresses() []string {
-	h.targetAddressesMutex.Lock()
-	defer h.targetAddressesMutex.Unlock()
-	return *h.targetAddresses
+	return controller.Addresses(h.GetTargets())
 }
 
+// SetTargetAddresses sets the targets to given addresses considered ready.
 func (h *multiplexingHandler) SetTargetAddresses(addresses []string) {
-	h.targetAddressesMutex.Lock()
-	defer h.targetAddressesMutex.Unlock()
-	h.targetAddresses = &addresses
+	targets := make([]controller.Target, 0, len(addresses))
+	for _, a := range addresses {
+		targets = append(targets, controller.Target{Address: a, Ready: true})
+	}
+	h.SetTargets(targets)
+}
+
+// SetSuccessPolicy sets the default success policy of the broadcasted requests overriding the allMustSucceed.
+func (h *multiplexingHandler) SetSuccessPolicy(policy SuccessPolicy) {
+	h.successPolicy = policy
+}
+
+// SetNotReadyBestEffort excludes the not ready targets from the success policy,
+// requests are still broadcasted to them but their responses are ignored.
+func (h *multiplexingHandler) SetNotReadyBestEffort(bestEffort bool) {
+	h.notReadyBestEffort = bestEffort
+}
+
+// SetClusters sets the clusters expected to have the targets, the one-per-cluster policy fails if any of them has none.
+func (h *multiplexingHandler) SetClusters(clusters []string) {
+	h.clusters = clusters
+}
+
+// SetLocalZone restricts the requests only to the targets in given zone.
+// If there is no target in the zone, all of them are used.
+func (h *multiplexingHandler) SetLocalZone(zone string) {
+	h.localZone = zone
+}
+
+// zoneTargets returns only the targets in the local zone if set.
+func (h *multiplexingHandler) zoneTargets(targets []controller.Target, reqLog *log.Entry) []controller.Target {
+	if h.localZone == "" {
+		return targets
+	}
+	var local []controller.Target
+	for _, t := range targets {
+		if t.Zone == h.localZone {
+			local = append(local, t)
+		}
+	}
+	if len(local) == 0 {
+		reqLog.Warnf("no targets in the local zone %v, falling back to all %d targets", h.localZone, len(targets))
+		return targets
+	}
+	return local
+}
+
+// SetCircuitBreaker configures the per target circuit breakers.
+func (h *multiplexingHandler) SetCircuitBreaker(config BreakerConfig) {
+	h.breakers = newCircuitBreakers(config)
 }
 
 func (h *multiplexingHandler) SetOwnAddress(addr string) {
 	h.ownAddress = addr
 }
 
-func (h *multiplexingHandler) handleRequest(req *http.Request) *http.Response {
+// SetMode sets the way requests are distributed to the targets.
+func (h *multiplexingHandler) SetMode(mode Mode) {
+	h.mode = mode
+}
+
+// SetHashHeader sets the header used to pick the target if the default mode is consistent-hash.
+func (h *multiplexingHandler) SetHashHeader(header string) {
+	h.hashHeader = header
+}
+
+// SetHedging configures the delay after which the hedged mode sends the request to another target.
+// If percentile is set, the delay is computed from the observed latencies instead once there are enough samples.
+func (h *multiplexingHandler) SetHedging(delay time.Duration, percentile float64) {
+	h.hedgeDelay = delay
+	h.hedgePercentile = percentile
+}
+
+// SetRoutes sets routes overriding the handling of matching requests, first matching route is used.
+// The routes can be replaced while serving the requests.
+func (h *multiplexingHandler) SetRoutes(routes []Route) {
+	h.routesMutex.Lock()
+	defer h.routesMutex.Unlock()
+	h.routes = routes
+}
+
+func (h *multiplexingHandler) handleRequest(target controller.Target, req *http.Request) *http.Response {
+	if !h.breakers.allow(req.URL.Host) {
+		return shortCircuitedResponse(req)
+	}
+	// There is no response header timeout, waiting for the response is bounded by the request context
+	// with timeout of the matched route, which can be longer than the --timeout.
 	transport := &http.Transport{
 		DialContext: (&net.Dialer{
 			Timeout:   h.timeout,
 			KeepAlive: 10 * h.timeout,
 		}).DialContext,
-		DisableKeepAlives:     !h.keepalive,
-		TLSHandshakeTimeout:   h.timeout,
-		ResponseHeaderTimeout: h.timeout,
+		DisableKeepAlives:   !h.keepalive,
+		TLSHandshakeTimeout: h.timeout,
 	}
+	h.balancer.started(req.URL.Host)
+	defer h.balancer.finished(req.URL.Host)
+	start := time.Now()
 	resp, err := transport.RoundTrip(req)
 	if err != nil {
 		resp = &http.Response{Request: req, StatusCode: 500, Status: fmt.Sprint(err), Body: ioutil.NopCloser(strings.NewReader(fmt.Sprint(err)))}
 	}
+	duration := time.Since(start)
+	if resp.StatusCode < 400 {
+		h.latencies.observe(duration)
+	}
+	backendRequestDurationSeconds.WithLabelValues(target.Cluster, target.Zone, strconv.Itoa(resp.StatusCode)).Observe(duration.Seconds())
+	// Cancelled requests say nothing about the target health, timed out ones are counted as failures.
+	switch req.Context().Err() {
+	case nil:
+		h.breakers.record(req.URL.Host, resp.StatusCode < 500)
+	case context.DeadlineExceeded:
+		h.breakers.record(req.URL.Host, false)
+	default:
+		h.breakers.release(req.URL.Host)
+	}
 	return resp
 }
 
-func (h *multiplexingHandler) decideFinalResponse(totalCount int, successfulResponses, failedResponses []*http.Response) *http.Response {
+// handleRequestWithRetries retries the request to the target up to retries times if it fails with error or 5xx status code.
+func (h *multiplexingHandler) handleRequestWithRetries(target controller.Target, req *http.Request, retries int, reqLog *log.Entry) *http.Response {
+	resp := h.handleRequest(target, req)
+	for attempt := 1; attempt <= retries && resp.StatusCode >= 500 && !isShortCircuited(resp) && req.Context().Err() == nil; attempt++ {
+		targetLog(reqLog, target).Debugf("retrying failed request to target=%v status_code=%v attempt=%v", target.Address, resp.StatusCode, attempt)
+		_ = resp.Body.Close()
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			retry.Body, _ = req.GetBody()
+		}
+		resp = h.handleRequest(target, retry)
+	}
+	return resp
+}
+
+func (h *multiplexingHandler) decideFinalResponse(policy SuccessPolicy, totalCount int, successfulResponses, failedResponses []*http.Response) *http.Response {
 	failedCount := len(failedResponses)
 	succeededCount := len(successfulResponses)
 
+	// Prefer real errors of the targets over the short-circuited ones.
+	var backendFailures []*http.Response
+	for _, r := range failedResponses {
+		if !isShortCircuited(r) {
+			backendFailures = append(backendFailures, r)
+		}
+	}
+	if len(backendFailures) > 0 {
+		failedResponses = backendFailures
+	}
+
 	if failedCount == 0 && succeededCount == 0 {
 		return newResponse(http.StatusServiceUnavailable, "no endpoints to query")
 	}
@@ -110,37 +315,121 @@ func (h *multiplexingHandler) decideFinalResponse(totalCount int, successfulResp
 	if failedCount == totalCount {
 		return randomResponse(failedResponses)
 	}
-	if failedCount > 0 && h.allMustSucceed {
+	if failedCount > 0 && policy == PolicyAll {
 		return randomResponse(failedResponses)
 	}
+	if succeededCount > 0 && policy == PolicyAny {
+		return randomResponse(successfulResponses)
+	}
 	return newResponse(http.StatusServiceUnavailable, "unknown error")
 }
 
 func (h *multiplexingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	ctx, cancelFunc := context.WithTimeout(context.Background(), h.timeout)
+	route := h.matchRoute(req)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), route.Timeout)
 	defer cancelFunc()
 	start := time.Now()
 	reqId := uuid.New()
 	reqLog := log.WithField("reqId", reqId)
 	reqLog.Debugf("received request %v, mirroring to targets...", req.URL)
+	user, authErr := h.authenticate(req, route)
+	var forbiddenResponse *http.Response
+	if user != nil {
+		reqLog = reqLog.WithField("user", user.Name)
+		forbiddenResponse = h.authorize(user, route, reqLog)
+	}
+
+	targets := h.GetTargets()
+	if route.Backend != "" {
+		targets = h.GetBackendTargets(route.Backend)
+	}
+	indexes := targetIndexes(targets)
+	targets = h.zoneTargets(targets, reqLog)
+	var readyTargets []controller.Target
+	for _, t := range targets {
+		if t.Ready {
+			readyTargets = append(readyTargets, t)
+		}
+	}
+
+	var finalResponse *http.Response
+	alreadySent := false
+	switch {
+	case authErr != nil:
+		reqLog.Infof("rejecting unauthenticated request %v %v: %v", req.Method, req.URL, authErr)
+		unauthenticatedRequestsTotal.Inc()
+		finalResponse = unauthorizedResponse(route.Auth)
+	case forbiddenResponse != nil:
+		finalResponse = forbiddenResponse
+	case route.Mode == ModeReject:
+		reqLog.Debugf("rejecting request %v %v matching reject rule", req.Method, req.URL)
+		finalResponse = newResponse(http.StatusForbidden, "request rejected by the broadcasting rules")
+	case route.Mode.IsUnicast():
+		finalResponse = h.unicastRequest(ctx, req, route, h.breakers.available(readyTargets), indexes, reqLog)
+	case route.Mode == ModeHedged:
+		finalResponse = h.hedgeRequest(ctx, req, route, h.breakers.available(readyTargets), indexes, reqLog)
+	default:
+		finalResponse, alreadySent = h.broadcastRequest(ctx, w, req, route, targets, indexes, reqLog)
+	}
+	if finalResponse == nil {
+		reqLog.Error("request timed out")
+		cancelFunc()
+		if alreadySent {
+			return
+		}
+		timeoutResponse := http.Response{
+			StatusCode: http.StatusGatewayTimeout,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("request timed out")),
+		}
+		h.sendResponse(w, req, route, &timeoutResponse, reqLog)
+		return
+	}
+
+	dur := time.Since(start)
+	reqLog.Infof("returned final status_code=%v for request=%v with duration=%v", finalResponse.StatusCode, finalResponse.Request.URL, dur)
+	requestDurationSeconds.WithLabelValues("HTTP", req.URL.Path, strconv.Itoa(finalResponse.StatusCode)).Observe(float64(dur))
+	if alreadySent {
+		return
+	}
+	h.sendResponse(w, req, route, finalResponse, reqLog)
+}
+
+// decideGroupedResponse succeeds if at least one target in each of the groups succeeded.
+func (h *multiplexingHandler) decideGroupedResponse(groupSucceeded map[string]bool, totalCount int, successfulResponses, failedResponses []*http.Response) *http.Response {
+	for group, succeeded := range groupSucceeded {
+		if !succeeded {
+			if len(failedResponses) == 0 {
+				// None of the targets of the group responded, e.g. the cluster has no targets.
+				return newResponse(http.StatusServiceUnavailable, fmt.Sprintf("no endpoints to query in %q", group))
+			}
+			return h.decideFinalResponse(PolicyAll, totalCount, successfulResponses, failedResponses)
+		}
+	}
+	return h.decideFinalResponse(PolicyAny, totalCount, successfulResponses, failedResponses)
+}
+
+// broadcastRequest sends the request to all targets in parallel and decides the final response.
+// Returns nil response if the request timed out and whether the response was already sent to the client.
+func (h *multiplexingHandler) broadcastRequest(ctx context.Context, w http.ResponseWriter, req *http.Request, route Route, targets []controller.Target, indexes map[string]int, reqLog *log.Entry) (*http.Response, bool) {
 	alreadySent := false
+	policy := route.SuccessPolicy
 
 	// Send requests to all targets in parallel and put the responses to channel
-	targets := h.GetTargetAddresses()
 	targetsCount := len(targets)
 
-	responseChannel := make(chan *http.Response, targetsCount)
+	responseChannel := make(chan targetResponse, targetsCount)
 	wg := sync.WaitGroup{}
 
 	for _, i := range rand.Perm(targetsCount) {
-		duplicate := duplicateRequest(req).WithContext(ctx)
-		if err := setRequestTarget(duplicate, targets[i], "http"); err != nil {
-			reqLog.Errorf("Failed to replace new target address, error: %v", err)
+		target := targets[i]
+		duplicate, err := h.targetRequest(ctx, req, route, target, indexes[target.Address])
+		if err != nil {
+			reqLog.Errorf("Failed to create request to target %v, error: %v", target.Address, err)
 			continue
 		}
 		wg.Add(1)
 		go func() {
-			responseChannel <- h.handleRequest(duplicate)
+			responseChannel <- targetResponse{target: target, response: h.handleRequestWithRetries(target, duplicate, route.Retries, reqLog)}
 			wg.Done()
 		}()
 	}
@@ -153,53 +442,84 @@ func (h *multiplexingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request
 	// Check all responses from the channel
 	requestCounter := 0
 	var successfulResponses, failedResponses []*http.Response
-mainLoop:
+	groupKey := policy.groupKey()
+	// Responses of the ignored targets do not count, so their groups are not required either.
+	var counted []controller.Target
+	for _, t := range targets {
+		if t.Ready || !h.notReadyBestEffort {
+			counted = append(counted, t)
+		}
+	}
+	groupSucceeded := policy.groups(counted, h.clusters)
 	for {
 		select {
 		case <-ctx.Done():
 			if ctx.Err() != context.DeadlineExceeded {
 				continue
 			}
-			reqLog.Error("request timed out")
-			cancelFunc()
-			timeoutResponse := http.Response{
-				StatusCode: http.StatusGatewayTimeout,
-				Body:       ioutil.NopCloser(bytes.NewBufferString("request timed out")),
-			}
-			sendResponse(w, &timeoutResponse)
-			return
-		case resp, ok := <-responseChannel:
+			return nil, alreadySent
+		case result, ok := <-responseChannel:
 			if !ok {
 				reqLog.Debug("done processing all broadcasted requests")
-				break mainLoop
+				if groupKey != nil {
+					return h.decideGroupedResponse(groupSucceeded, requestCounter, successfulResponses, failedResponses), alreadySent
+				}
+				return h.decideFinalResponse(policy, requestCounter, successfulResponses, failedResponses), alreadySent
+			}
+			resp := result.response
+			if !result.target.Ready && h.notReadyBestEffort {
+				reqLog.Debugf("ignoring response of not ready target=%v status_code=%v", result.target.Address, resp.StatusCode)
+				_ = resp.Body.Close()
+				continue
 			}
 			requestCounter++
-			if resp.StatusCode >= 400 {
-				buf := new(bytes.Buffer)
-				if _, err := buf.ReadFrom(resp.Body); err != nil {
-					reqLog.Errorf("failed to read response body: %v", err)
+			if groupKey != nil {
+				if key, ok := groupKey(result.target); ok {
+					groupSucceeded[key] = groupSucceeded[key] || resp.StatusCode < 400
+				} else {
+					reqLog.Debugf("target=%v without zone is not counted to any zone", result.target.Address)
 				}
-				errorMsg := buf.String()
-				reqLog.Warnf("replica=%v request=%v status_code=%v error=%v", requestCounter, resp.Request.URL, resp.StatusCode, errorMsg)
+			}
+			if resp.StatusCode >= 400 {
+				logFailedResponse(targetLog(reqLog, result.target), requestCounter, resp)
 				failedResponses = append(failedResponses, resp)
 			} else {
-				reqLog.Debugf("replica=%v request=%v status_code=%v", requestCounter, resp.Request.URL, resp.StatusCode)
+				targetLog(reqLog, result.target).Debugf("replica=%v request=%v status_code=%v", requestCounter, resp.Request.URL, resp.StatusCode)
 				successfulResponses = append(successfulResponses, resp)
-				if !h.allMustSucceed && !alreadySent {
-					sendResponse(w, resp)
+				if policy == PolicyAny && !alreadySent {
+					h.sendResponse(w, req, route, resp, reqLog)
 					alreadySent = true
 				}
 			}
 		}
 	}
+}
 
-	finalResponse := h.decideFinalResponse(requestCounter, successfulResponses, failedResponses)
+type targetResponse struct {
+	target   controller.Target
+	response *http.Response
+}
 
-	dur := time.Since(start)
-	reqLog.Infof("returned final status_code=%v for request=%v with duration=%v", finalResponse.StatusCode, finalResponse.Request.URL, dur)
-	requestDurationSeconds.WithLabelValues("HTTP", req.URL.Path, strconv.Itoa(finalResponse.StatusCode)).Observe(float64(dur))
-	if alreadySent {
-		return
+// targetLog adds the known metadata of the target to the log entry.
+func targetLog(reqLog *log.Entry, target controller.Target) *log.Entry {
+	fields := log.Fields{}
+	for name, value := range map[string]string{"pod": target.Pod, "node": target.Node, "zone": target.Zone} {
+		if value != "" {
+			fields[name] = value
+		}
+	}
+	if !target.Ready {
+		fields["ready"] = false
+	}
+	return reqLog.WithFields(fields)
+}
+
+func logFailedResponse(reqLog *log.Entry, replica int, resp *http.Response) {
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(resp.Body); err != nil {
+		reqLog.Errorf("failed to read response body: %v", err)
 	}
-	sendResponse(w, finalResponse)
+	errorMsg := buf.String()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(buf.Bytes()))
+	reqLog.Warnf("replica=%v request=%v status_code=%v error=%v", replica, resp.Request.URL, resp.StatusCode, errorMsg)
 }
@@ -0,0 +1,276 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"text/template"
+)
+
+// Hop-by-hop headers are meaningful only for single connection and must not be forwarded, see RFC 7230 section 6.1.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers including the ones listed in the Connection header.
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// ForwardedMode is how the X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host and Forwarded headers
+// of the requests sent to the targets are set.
+type ForwardedMode string
+
+const (
+	// ForwardedAppend adds the client to the headers of the incoming request.
+	ForwardedAppend ForwardedMode = "append"
+	// ForwardedReplace drops the headers of the incoming request and sets them only to the client, e.g. for untrusted clients.
+	ForwardedReplace ForwardedMode = "replace"
+	// ForwardedOff passes the headers of the incoming request unchanged.
+	ForwardedOff ForwardedMode = "off"
+)
+
+// ParseForwardedMode parses the forwarded headers mode from string.
+func ParseForwardedMode(mode string) (ForwardedMode, error) {
+	switch m := ForwardedMode(mode); m {
+	case ForwardedAppend, ForwardedReplace, ForwardedOff:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown forwarded headers mode %v, supported are %v, %v and %v", mode, ForwardedAppend, ForwardedReplace, ForwardedOff)
+}
+
+// setForwardedHeaders sets the forwarded headers of the duplicate according to the original request.
+func setForwardedHeaders(duplicate, original *http.Request, mode ForwardedMode) {
+	if mode == ForwardedOff {
+		return
+	}
+	header := duplicate.Header
+	if mode == ForwardedReplace {
+		for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+			header.Del(name)
+		}
+	}
+	clientIP, _, err := net.SplitHostPort(original.RemoteAddr)
+	if err != nil {
+		clientIP = ""
+	}
+	proto := "http"
+	if original.TLS != nil {
+		proto = "https"
+	}
+	if clientIP != "" {
+		if prior := header["X-Forwarded-For"]; len(prior) > 0 {
+			header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+clientIP)
+		} else {
+			header.Set("X-Forwarded-For", clientIP)
+		}
+	}
+	if header.Get("X-Forwarded-Proto") == "" {
+		header.Set("X-Forwarded-Proto", proto)
+	}
+	if header.Get("X-Forwarded-Host") == "" && original.Host != "" {
+		header.Set("X-Forwarded-Host", original.Host)
+	}
+	forwardedFor := "unknown"
+	if clientIP != "" {
+		forwardedFor = clientIP
+		if strings.Contains(clientIP, ":") {
+			forwardedFor = fmt.Sprintf("\"[%v]\"", clientIP)
+		}
+	}
+	forwarded := fmt.Sprintf("for=%v;proto=%v", forwardedFor, proto)
+	if original.Host != "" {
+		forwarded += fmt.Sprintf(";host=%q", original.Host)
+	}
+	header.Add("Forwarded", forwarded)
+}
+
+// HeaderRulesConfig configures headers of the requests or responses, the values are Go templates
+// with the .Target the request is sent to, its .Index and .Ordinal and the incoming .Request.
+type HeaderRulesConfig struct {
+	Add    map[string]string `json:"add,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+// ParseRule adds the rule in format add:<name>=<value>, set:<name>=<value> or remove:<name> to the config.
+func (c *HeaderRulesConfig) ParseRule(rule string) error {
+	parts := strings.SplitN(rule, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return fmt.Errorf("invalid header rule %v, expected format is add:<name>=<value>, set:<name>=<value> or remove:<name>", rule)
+	}
+	if parts[0] == "remove" {
+		c.Remove = append(c.Remove, parts[1])
+		return nil
+	}
+	header := strings.SplitN(parts[1], "=", 2)
+	if len(header) != 2 || header[0] == "" {
+		return fmt.Errorf("invalid header rule %v, expected format is %v:<name>=<value>", rule, parts[0])
+	}
+	switch parts[0] {
+	case "add":
+		if c.Add == nil {
+			c.Add = map[string]string{}
+		}
+		c.Add[header[0]] = header[1]
+	case "set":
+		if c.Set == nil {
+			c.Set = map[string]string{}
+		}
+		c.Set[header[0]] = header[1]
+	default:
+		return fmt.Errorf("invalid header rule %v, unknown action %v", rule, parts[0])
+	}
+	return nil
+}
+
+// Rules compiles the templates of the header values.
+func (c HeaderRulesConfig) Rules() (*HeaderRules, error) {
+	add, err := compileHeaderTemplates(c.Add)
+	if err != nil {
+		return nil, err
+	}
+	set, err := compileHeaderTemplates(c.Set)
+	if err != nil {
+		return nil, err
+	}
+	return &HeaderRules{add: add, set: set, remove: c.Remove}, nil
+}
+
+func compileHeaderTemplates(values map[string]string) (map[string]*template.Template, error) {
+	templates := map[string]*template.Template{}
+	for name, value := range values {
+		t, err := template.New(name).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template of header %v: %w", name, err)
+		}
+		templates[name] = t
+	}
+	return templates, nil
+}
+
+// HeaderRules remove, set and add the headers in this order.
+type HeaderRules struct {
+	add    map[string]*template.Template
+	set    map[string]*template.Template
+	remove []string
+}
+
+func (r *HeaderRules) apply(header http.Header, data templateData) error {
+	if r == nil {
+		return nil
+	}
+	for _, name := range r.remove {
+		header.Del(name)
+	}
+	for _, action := range []struct {
+		templates map[string]*template.Template
+		setValue  func(name, value string)
+	}{
+		{templates: r.set, setValue: header.Set},
+		{templates: r.add, setValue: header.Add},
+	} {
+		for name, t := range action.templates {
+			value, err := renderTemplate(t, data)
+			if err != nil {
+				return fmt.Errorf("failed to render value of header %v: %w", name, err)
+			}
+			action.setValue(name, value)
+		}
+	}
+	return nil
+}
+
+// SetForwardedHeaders sets how the forwarded headers of the requests sent to the targets are set.
+func (h *multiplexingHandler) SetForwardedHeaders(mode ForwardedMode) {
+	h.forwardedMode = mode
+}
+
+// SetHeaderRules sets the rules of headers of the requests sent to the targets and of the responses,
+// they are applied before the rules of the routes.
+func (h *multiplexingHandler) SetHeaderRules(request, response *HeaderRules) {
+	h.requestHeaders = request
+	h.responseHeaders = response
+}
+
+type targetContextKey struct{}
+
+// targetRequest duplicates the request for the target with the rewrites and headers set according to the configuration,
+// the index is position of the target among all the targets of the route, see templateData.
+func (h *multiplexingHandler) targetRequest(ctx context.Context, req *http.Request, route Route, target controller.Target, index int) (*http.Request, error) {
+	data := newTemplateData(req, target, index)
+	duplicate := duplicateRequest(req).WithContext(context.WithValue(ctx, targetContextKey{}, data))
+	removeHopByHopHeaders(duplicate.Header)
+	setForwardedHeaders(duplicate, req, h.forwardedMode)
+	if err := setRequestTarget(duplicate, target.Address, "http"); err != nil {
+		return nil, err
+	}
+	for _, rewrite := range []*Rewrite{h.rewrite, route.Rewrite} {
+		if err := rewrite.apply(duplicate, data); err != nil {
+			return nil, err
+		}
+	}
+	h.setBackendCredentials(duplicate)
+	for _, rules := range []*HeaderRules{h.requestHeaders, route.RequestHeaders} {
+		if err := rules.apply(duplicate.Header, data); err != nil {
+			return nil, err
+		}
+	}
+	return duplicate, nil
+}
+
+// sendResponse sends the response to the client with the headers set according to the configuration.
+func (h *multiplexingHandler) sendResponse(w http.ResponseWriter, req *http.Request, route Route, resp *http.Response, reqLog *log.Entry) {
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	removeHopByHopHeaders(resp.Header)
+	data := templateData{Index: -1, Ordinal: -1}
+	if resp.Request != nil {
+		if targetData, ok := resp.Request.Context().Value(targetContextKey{}).(templateData); ok {
+			data = targetData
+		}
+	}
+	data.Request = req
+	for _, rules := range []*HeaderRules{h.responseHeaders, route.ResponseHeaders} {
+		if err := rules.apply(resp.Header, data); err != nil {
+			reqLog.Errorf("failed to set response headers: %v", err)
+		}
+	}
+	sendResponse(w, resp)
+}
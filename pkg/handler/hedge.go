@@ -0,0 +1,169 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	latencyWindowSize = 1000
+	// Minimal number of observed latencies to use the percentile for hedging.
+	minLatencySamples = 20
+)
+
+type hedgeResult struct {
+	attempt  int
+	response *http.Response
+}
+
+// hedgeRequest sends the request to one random target and if it does not respond within the hedge delay
+// or fails, sends it to the next one. First successful response wins and the other requests are cancelled.
+// Returns nil if the request timed out.
+func (h *multiplexingHandler) hedgeRequest(ctx context.Context, req *http.Request, route Route, targets []controller.Target, indexes map[string]int, reqLog *log.Entry) *http.Response {
+	if len(targets) == 0 {
+		return newResponse(http.StatusServiceUnavailable, "no endpoints to query")
+	}
+	delay := h.currentHedgeDelay()
+	order := rand.Perm(len(targets))
+	resultChannel := make(chan hedgeResult, len(targets))
+	var cancelFuncs []context.CancelFunc
+
+	sendNext := func() bool {
+		for len(cancelFuncs) < len(order) {
+			attempt := len(cancelFuncs)
+			attemptCtx, cancel := context.WithCancel(ctx)
+			cancelFuncs = append(cancelFuncs, cancel)
+			target := targets[order[attempt]]
+			duplicate, err := h.targetRequest(attemptCtx, req, route, target, indexes[target.Address])
+			if err != nil {
+				reqLog.Errorf("Failed to create request to target %v, error: %v", target.Address, err)
+				cancel()
+				continue
+			}
+			targetLog(reqLog, target).Debugf("hedging attempt=%v to target=%v", attempt+1, target.Address)
+			go func() {
+				resultChannel <- hedgeResult{attempt: attempt, response: h.handleRequest(target, duplicate)}
+			}()
+			return true
+		}
+		return false
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	inFlight := 0
+	if sendNext() {
+		inFlight++
+	}
+	var failedResponses []*http.Response
+	for inFlight > 0 {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			if sendNext() {
+				inFlight++
+				timer.Reset(delay)
+			}
+		case result := <-resultChannel:
+			inFlight--
+			resp := result.response
+			if resp.StatusCode >= 400 {
+				if ctx.Err() != nil {
+					return nil
+				}
+				logFailedResponse(reqLog, result.attempt+1, resp)
+				failedResponses = append(failedResponses, resp)
+				if sendNext() {
+					inFlight++
+				}
+				continue
+			}
+			reqLog.Debugf("replica=%v request=%v status_code=%v won the hedged request", result.attempt+1, resp.Request.URL, resp.StatusCode)
+			for i, cancel := range cancelFuncs {
+				if i != result.attempt {
+					cancel()
+				}
+			}
+			go drainHedgeResults(resultChannel, inFlight)
+			return resp
+		}
+	}
+	if len(failedResponses) == 0 {
+		return newResponse(http.StatusServiceUnavailable, "no endpoints to query")
+	}
+	return randomResponse(failedResponses)
+}
+
+func drainHedgeResults(results chan hedgeResult, count int) {
+	for ; count > 0; count-- {
+		result := <-results
+		_ = result.response.Body.Close()
+	}
+}
+
+func (h *multiplexingHandler) currentHedgeDelay() time.Duration {
+	if h.hedgePercentile > 0 {
+		if d, ok := h.latencies.percentile(h.hedgePercentile); ok {
+			return d
+		}
+	}
+	return h.hedgeDelay
+}
+
+func newLatencyWindow(size int) *latencyWindow {
+	return &latencyWindow{
+		samples: make([]time.Duration, 0, size),
+		size:    size,
+	}
+}
+
+// latencyWindow holds the most recent latencies of successful requests.
+type latencyWindow struct {
+	samples []time.Duration
+	size    int
+	next    int
+	mtx     sync.Mutex
+}
+
+func (l *latencyWindow) observe(d time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if len(l.samples) < l.size {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % l.size
+}
+
+func (l *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	l.mtx.Lock()
+	sorted := make([]time.Duration, len(l.samples))
+	copy(sorted, l.samples)
+	l.mtx.Unlock()
+	if len(sorted) < minLatencySamples {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(p*float64(len(sorted)-1))], true
+}
@@ -0,0 +1,220 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	clientLimitersCleanupInterval = time.Minute
+)
+
+var (
+	limitedRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "limited_requests_total",
+			Help: "Number of requests rejected by the limits.",
+		},
+		[]string{"reason"},
+	)
+	requestsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "requests_in_flight",
+			Help: "Number of incoming requests being currently broadcasted.",
+		},
+	)
+	requestsQueued = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "requests_queued",
+			Help: "Number of incoming requests waiting for the limits.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(limitedRequestsTotal, requestsInFlight, requestsQueued)
+}
+
+// LimitsConfig configures limits of the incoming requests, zero values disable the limit.
+type LimitsConfig struct {
+	// Rate is the maximum number of requests per second from all clients.
+	Rate  float64
+	Burst int
+	// ClientRate is the maximum number of requests per second from single client IP.
+	ClientRate  float64
+	ClientBurst int
+	// MaxInFlight is the maximum number of requests being broadcasted at once.
+	MaxInFlight int
+	// QueueTimeout is how long can request wait for the limits, if zero it is rejected immediately.
+	QueueTimeout time.Duration
+}
+
+// NewLimitingHandler wraps the handler with rate and concurrency limits.
+func NewLimitingHandler(next http.Handler, config LimitsConfig) *limitingHandler {
+	h := &limitingHandler{
+		next:           next,
+		config:         config,
+		clientLimiters: map[string]*clientLimiter{},
+		lastCleanup:    time.Now(),
+	}
+	if config.Rate > 0 {
+		h.limiter = rate.NewLimiter(rate.Limit(config.Rate), burst(config.Burst, config.Rate))
+	}
+	if config.MaxInFlight > 0 {
+		h.inFlight = make(chan struct{}, config.MaxInFlight)
+	}
+	return h
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+type limitingHandler struct {
+	next              http.Handler
+	config            LimitsConfig
+	limiter           *rate.Limiter
+	inFlight          chan struct{}
+	clientLimiters    map[string]*clientLimiter
+	clientLimitersMtx sync.Mutex
+	lastCleanup       time.Time
+}
+
+func burst(burst int, limit float64) int {
+	if burst > 0 {
+		return burst
+	}
+	if limit < 1 {
+		return 1
+	}
+	return int(limit)
+}
+
+func (h *limitingHandler) clientLimiter(ip string) *rate.Limiter {
+	h.clientLimitersMtx.Lock()
+	defer h.clientLimitersMtx.Unlock()
+	now := time.Now()
+	if now.Sub(h.lastCleanup) > clientLimitersCleanupInterval {
+		for k, l := range h.clientLimiters {
+			if now.Sub(l.lastSeen) > clientLimitersCleanupInterval {
+				delete(h.clientLimiters, k)
+			}
+		}
+		h.lastCleanup = now
+	}
+	l, ok := h.clientLimiters[ip]
+	if !ok {
+		l = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(h.config.ClientRate), burst(h.config.ClientBurst, h.config.ClientRate))}
+		h.clientLimiters[ip] = l
+	}
+	l.lastSeen = now
+	return l.limiter
+}
+
+// queuedRequest counts the request as queued once it has to wait for the limits.
+type queuedRequest struct {
+	queued bool
+}
+
+func (q *queuedRequest) enqueue() {
+	if !q.queued {
+		requestsQueued.Inc()
+		q.queued = true
+	}
+}
+
+func (q *queuedRequest) dequeue() {
+	if q.queued {
+		requestsQueued.Dec()
+		q.queued = false
+	}
+}
+
+func (h *limitingHandler) wait(ctx context.Context, limiter *rate.Limiter, q *queuedRequest) bool {
+	if limiter.Allow() {
+		return true
+	}
+	if h.config.QueueTimeout == 0 {
+		return false
+	}
+	q.enqueue()
+	return limiter.Wait(ctx) == nil
+}
+
+func (h *limitingHandler) acquire(ctx context.Context, q *queuedRequest) bool {
+	select {
+	case h.inFlight <- struct{}{}:
+		return true
+	default:
+	}
+	if h.config.QueueTimeout == 0 {
+		return false
+	}
+	q.enqueue()
+	select {
+	case h.inFlight <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func reject(w http.ResponseWriter, status int, reason string) {
+	limitedRequestsTotal.WithLabelValues(reason).Inc()
+	log.Debugf("rejecting request due to %v limit", reason)
+	http.Error(w, fmt.Sprintf("%v limit exceeded", reason), status)
+}
+
+func (h *limitingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	ctx, cancelFunc := context.WithTimeout(req.Context(), h.config.QueueTimeout)
+	defer cancelFunc()
+	q := &queuedRequest{}
+	defer q.dequeue()
+
+	if h.limiter != nil && !h.wait(ctx, h.limiter, q) {
+		reject(w, http.StatusTooManyRequests, "rate")
+		return
+	}
+	if h.config.ClientRate > 0 {
+		ip, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			ip = req.RemoteAddr
+		}
+		if !h.wait(ctx, h.clientLimiter(ip), q) {
+			reject(w, http.StatusTooManyRequests, "client_rate")
+			return
+		}
+	}
+	if h.inFlight != nil {
+		if !h.acquire(ctx, q) {
+			reject(w, http.StatusServiceUnavailable, "in_flight")
+			return
+		}
+		defer func() { <-h.inFlight }()
+	}
+	q.dequeue()
+	requestsInFlight.Inc()
+	defer requestsInFlight.Dec()
+	h.next.ServeHTTP(w, req)
+}
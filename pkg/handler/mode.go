@@ -0,0 +1,62 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Mode determines how is the incoming request distributed to the targets.
+type Mode string
+
+const (
+	// ModeBroadcast sends the request to all targets.
+	ModeBroadcast Mode = "broadcast"
+	// ModeHedged sends the request to one target and to additional ones if it does not respond in time.
+	ModeHedged Mode = "hedged"
+	// ModeRoundRobin sends the request to single target, targets are rotated.
+	ModeRoundRobin Mode = "round-robin"
+	// ModeLeastInFlight sends the request to single target with the least requests in flight.
+	ModeLeastInFlight Mode = "least-in-flight"
+	// ModeConsistentHash sends the request to single target chosen by hash of the configured header.
+	ModeConsistentHash Mode = "consistent-hash"
+	// ModeReject does not send the request anywhere and rejects it.
+	ModeReject Mode = "reject"
+)
+
+var modes = []Mode{ModeBroadcast, ModeHedged, ModeRoundRobin, ModeLeastInFlight, ModeConsistentHash, ModeReject}
+
+// IsUnicast returns true if the mode sends the request only to single target.
+func (m Mode) IsUnicast() bool {
+	return m == ModeRoundRobin || m == ModeLeastInFlight || m == ModeConsistentHash
+}
+
+// ParseMode returns the Mode matching given name.
+func ParseMode(name string) (Mode, error) {
+	for _, m := range modes {
+		if string(m) == name {
+			return m, nil
+		}
+	}
+	return "", fmt.Errorf("unknown mode %v, supported modes are: %v", name, modeNames())
+}
+
+func modeNames() string {
+	var names []string
+	for _, m := range modes {
+		names = append(names, string(m))
+	}
+	return strings.Join(names, ", ")
+}
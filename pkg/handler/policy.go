@@ -0,0 +1,121 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"strings"
+)
+
+// SuccessPolicy determines when is the broadcasted request considered successful.
+type SuccessPolicy string
+
+const (
+	// PolicyAll requires all targets to succeed.
+	PolicyAll SuccessPolicy = "all"
+	// PolicyAny requires at least one target to succeed.
+	PolicyAny SuccessPolicy = "any"
+	// PolicyOnePerCluster requires at least one target in each cluster to succeed.
+	PolicyOnePerCluster SuccessPolicy = "one-per-cluster"
+	// PolicyOnePerZone requires at least one target in each zone to succeed.
+	PolicyOnePerZone SuccessPolicy = "one-per-zone"
+)
+
+var policies = []SuccessPolicy{PolicyAll, PolicyAny, PolicyOnePerCluster, PolicyOnePerZone}
+
+// ParseSuccessPolicy returns the SuccessPolicy matching given name.
+func ParseSuccessPolicy(name string) (SuccessPolicy, error) {
+	for _, p := range policies {
+		if string(p) == name {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown success policy %v, supported policies are: %v", name, policyNames())
+}
+
+func policyNames() string {
+	var names []string
+	for _, p := range policies {
+		names = append(names, string(p))
+	}
+	return strings.Join(names, ", ")
+}
+
+// groupKey returns function grouping the targets if the policy requires success in each group, nil otherwise.
+// Targets with unknown zone are not in any zone, so they neither form a group nor satisfy one.
+func (p SuccessPolicy) groupKey() func(controller.Target) (string, bool) {
+	switch p {
+	case PolicyOnePerCluster:
+		return func(t controller.Target) (string, bool) { return t.Cluster, true }
+	case PolicyOnePerZone:
+		return func(t controller.Target) (string, bool) { return t.Zone, t.Zone != "" }
+	}
+	return nil
+}
+
+// groups returns the groups the policy requires a success in, none of them succeeded yet.
+// The groups are the clusters expected to have the targets and the groups of the targets the request is sent to,
+// so a cluster without any targets fails the one-per-cluster policy. Nil if the policy does not group the targets.
+func (p SuccessPolicy) groups(targets []controller.Target, clusters []string) map[string]bool {
+	groupKey := p.groupKey()
+	if groupKey == nil {
+		return nil
+	}
+	groups := map[string]bool{}
+	if p == PolicyOnePerCluster {
+		for _, c := range clusters {
+			groups[c] = false
+		}
+	}
+	for _, t := range targets {
+		if key, ok := groupKey(t); ok {
+			groups[key] = false
+		}
+	}
+	return groups
+}
+
+// Succeeded returns true if the results satisfy the policy, the clusters are the ones expected to have the targets.
+func (p SuccessPolicy) Succeeded(results []TargetResult, clusters []string) bool {
+	if len(results) == 0 {
+		return false
+	}
+	groupKey := p.groupKey()
+	targets := make([]controller.Target, 0, len(results))
+	for _, r := range results {
+		targets = append(targets, r.Target)
+	}
+	groupSucceeded := p.groups(targets, clusters)
+	failed := 0
+	for _, r := range results {
+		if r.Failed() {
+			failed++
+		}
+		if groupKey != nil {
+			if key, ok := groupKey(r.Target); ok {
+				groupSucceeded[key] = groupSucceeded[key] || !r.Failed()
+			}
+		}
+	}
+	for _, succeeded := range groupSucceeded {
+		if !succeeded {
+			return false
+		}
+	}
+	if p == PolicyAll {
+		return failed == 0
+	}
+	return failed < len(results)
+}
@@ -0,0 +1,149 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// templateData is available to the templates of the rewrites and header values.
+type templateData struct {
+	Target controller.Target
+	// Index is position of the target among all the discovered targets of the route in the order of the discovery,
+	// it is the same in all the modes regardless of which of the targets are ready, healthy or in the local zone.
+	Index int
+	// Ordinal is the numeric suffix of the pod name, -1 if there is none. The discovery does not know owner of the pod,
+	// so it is the StatefulSet ordinal only for the StatefulSet pods, other pods get any numeric suffix of their name.
+	Ordinal int
+	Request *http.Request
+}
+
+func newTemplateData(req *http.Request, target controller.Target, index int) templateData {
+	return templateData{Target: target, Index: index, Ordinal: podOrdinal(target.Pod), Request: req}
+}
+
+// podOrdinal returns the numeric suffix of the pod name, which is the ordinal of the StatefulSet pods, -1 if there is none.
+func podOrdinal(pod string) int {
+	i := strings.LastIndex(pod, "-")
+	if i < 0 {
+		return -1
+	}
+	ordinal, err := strconv.Atoi(pod[i+1:])
+	if err != nil || ordinal < 0 {
+		return -1
+	}
+	return ordinal
+}
+
+// targetIndexes returns the Index of the targets by their address.
+func targetIndexes(targets []controller.Target) map[string]int {
+	indexes := make(map[string]int, len(targets))
+	for i, t := range targets {
+		indexes[t.Address] = i
+	}
+	return indexes
+}
+
+// RewriteConfig configures rewrite of the requests sent to the targets, the values are Go templates
+// with the .Target, its .Index and .Ordinal and the incoming .Request.
+type RewriteConfig struct {
+	// Path replaces path of the request.
+	Path string `json:"path,omitempty"`
+	// Query sets the query parameters of the request.
+	Query map[string]string `json:"query,omitempty"`
+}
+
+// ParseQuery adds the query parameter rewrite in format <name>=<value> to the config.
+func (c *RewriteConfig) ParseQuery(param string) error {
+	parts := strings.SplitN(param, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("invalid query parameter rewrite %v, expected format is <name>=<value>", param)
+	}
+	if c.Query == nil {
+		c.Query = map[string]string{}
+	}
+	c.Query[parts[0]] = parts[1]
+	return nil
+}
+
+// Rewrite compiles the templates of the rewrite.
+func (c RewriteConfig) Rewrite() (*Rewrite, error) {
+	r := &Rewrite{query: map[string]*template.Template{}}
+	var err error
+	if c.Path != "" {
+		if r.path, err = template.New("path").Option("missingkey=error").Parse(c.Path); err != nil {
+			return nil, fmt.Errorf("invalid template of path: %w", err)
+		}
+	}
+	for name, value := range c.Query {
+		if r.query[name], err = template.New(name).Option("missingkey=error").Parse(value); err != nil {
+			return nil, fmt.Errorf("invalid template of query parameter %v: %w", name, err)
+		}
+	}
+	return r, nil
+}
+
+// Rewrite rewrites the path and query parameters of the requests sent to the targets.
+type Rewrite struct {
+	path  *template.Template
+	query map[string]*template.Template
+}
+
+func renderTemplate(t *template.Template, data templateData) (string, error) {
+	buf := new(bytes.Buffer)
+	if err := t.Execute(buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func (r *Rewrite) apply(req *http.Request, data templateData) error {
+	if r == nil {
+		return nil
+	}
+	if r.path != nil {
+		path, err := renderTemplate(r.path, data)
+		if err != nil {
+			return fmt.Errorf("failed to render path: %w", err)
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		req.URL.Path = path
+		req.URL.RawPath = ""
+	}
+	if len(r.query) > 0 {
+		query := req.URL.Query()
+		for name, t := range r.query {
+			value, err := renderTemplate(t, data)
+			if err != nil {
+				return fmt.Errorf("failed to render query parameter %v: %w", name, err)
+			}
+			query.Set(name, value)
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+	return nil
+}
+
+// SetRewrite sets the rewrite of the requests sent to the targets, it is applied before the rewrite of the routes.
+func (h *multiplexingHandler) SetRewrite(rewrite *Rewrite) {
+	h.rewrite = rewrite
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/auth"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Route overrides the handling of matching requests. Empty matchers match any request,
+// empty settings fall back to the handler defaults.
+type Route struct {
+	// Host is matched against the request host without port.
+	Host       string
+	PathPrefix string
+	Path       *regexp.Regexp
+	Methods    []string
+	Headers    map[string]*regexp.Regexp
+
+	Mode Mode
+	// HashHeader is name of the header used to pick target in the consistent-hash mode.
+	HashHeader    string
+	SuccessPolicy SuccessPolicy
+	Timeout       time.Duration
+	// Retries is number of retries of the requests to single target failing with error or 5xx status code.
+	Retries int
+	// Auth are the authentication methods accepted for the requests, the handler defaults are used if empty.
+	Auth []auth.Method
+	// Objects are the objects the requests are sent to, the user has to be authorized to access all of them.
+	// The handler defaults are used if empty.
+	Objects []auth.Object
+	// RequestHeaders and ResponseHeaders are applied after the handler header rules.
+	RequestHeaders  *HeaderRules
+	ResponseHeaders *HeaderRules
+	// Rewrite is applied after the handler rewrite.
+	Rewrite *Rewrite
+	// Backend is name of the targets set by SetBackendTargets to send the requests to, the default targets are used if empty.
+	Backend string
+}
+
+// ParseRoute parses route in format `<path-prefix>=<mode>` or `<path-prefix>=consistent-hash:<header>`.
+func ParseRoute(route string) (Route, error) {
+	parts := strings.SplitN(route, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return Route{}, fmt.Errorf("invalid route %v, expected format is <path-prefix>=<mode>", route)
+	}
+	modeParts := strings.SplitN(parts[1], ":", 2)
+	mode, err := ParseMode(modeParts[0])
+	if err != nil {
+		return Route{}, err
+	}
+	r := Route{PathPrefix: parts[0], Mode: mode}
+	if len(modeParts) == 2 {
+		r.HashHeader = modeParts[1]
+	}
+	if r.Mode == ModeConsistentHash && r.HashHeader == "" {
+		return Route{}, fmt.Errorf("invalid route %v, consistent-hash mode requires header name in format <path-prefix>=consistent-hash:<header>", route)
+	}
+	return r, nil
+}
+
+func (r Route) matches(req *http.Request) bool {
+	if r.Host != "" && !strings.EqualFold(requestHost(req), r.Host) {
+		return false
+	}
+	if !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+		return false
+	}
+	if r.Path != nil && !r.Path.MatchString(req.URL.Path) {
+		return false
+	}
+	if len(r.Methods) > 0 {
+		methodMatched := false
+		for _, m := range r.Methods {
+			if m == req.Method {
+				methodMatched = true
+				break
+			}
+		}
+		if !methodMatched {
+			return false
+		}
+	}
+	for name, re := range r.Headers {
+		if !re.MatchString(req.Header.Get(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestHost returns host of the request without the port.
+func requestHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		return req.Host
+	}
+	return host
+}
+
+// matchRoute returns the first matching route with unset settings filled with the handler defaults.
+func (h *multiplexingHandler) matchRoute(req *http.Request) Route {
+	h.routesMutex.RLock()
+	defer h.routesMutex.RUnlock()
+	matched := Route{}
+	for _, r := range h.routes {
+		if r.matches(req) {
+			matched = r
+			break
+		}
+	}
+	if matched.Mode == "" {
+		matched.Mode = h.mode
+		if matched.HashHeader == "" {
+			matched.HashHeader = h.hashHeader
+		}
+	}
+	if matched.SuccessPolicy == "" {
+		matched.SuccessPolicy = h.successPolicy
+	}
+	if matched.SuccessPolicy == "" {
+		matched.SuccessPolicy = PolicyAny
+		if h.allMustSucceed {
+			matched.SuccessPolicy = PolicyAll
+		}
+	}
+	if matched.Timeout == 0 {
+		matched.Timeout = h.timeout
+	}
+	if len(matched.Auth) == 0 {
+		matched.Auth = h.authMethods
+	}
+	if len(matched.Objects) == 0 {
+		matched.Objects = h.authzObjects
+	}
+	return matched
+}
@@ -0,0 +1,181 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/auth"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"io/ioutil"
+	"regexp"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"time"
+)
+
+// RulesConfig is the content of the rules file.
+type RulesConfig struct {
+	Rules []RuleConfig `json:"rules"`
+}
+
+// RuleConfig is a single rule from the rules file, all the specified matchers must match the request.
+// The Headers are regular expressions the whole values of the headers have to match.
+type RuleConfig struct {
+	Host    string            `json:"host,omitempty"`
+	Methods []string          `json:"methods,omitempty"`
+	Path    string            `json:"path,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	// Mode to handle matching requests with, one of the modes or reject.
+	Mode          string `json:"mode,omitempty"`
+	HashHeader    string `json:"hashHeader,omitempty"`
+	SuccessPolicy string `json:"successPolicy,omitempty"`
+	Timeout       string `json:"timeout,omitempty"`
+	Retries       int    `json:"retries,omitempty"`
+	// Auth are the authentication methods accepted for matching requests, none allows anonymous requests.
+	Auth []string `json:"auth,omitempty"`
+	// RequestHeaders and ResponseHeaders modify headers of the requests sent to the targets and of the responses.
+	RequestHeaders  *HeaderRulesConfig `json:"requestHeaders,omitempty"`
+	ResponseHeaders *HeaderRulesConfig `json:"responseHeaders,omitempty"`
+	// Rewrite rewrites the requests sent to each of the targets.
+	Rewrite *RewriteConfig `json:"rewrite,omitempty"`
+}
+
+// Route converts the rule to a route.
+func (c RuleConfig) Route() (Route, error) {
+	var err error
+	if c.Retries < 0 {
+		return Route{}, fmt.Errorf("invalid number of retries %d", c.Retries)
+	}
+	r := Route{Host: c.Host, HashHeader: c.HashHeader, Retries: c.Retries}
+	for _, m := range c.Methods {
+		r.Methods = append(r.Methods, strings.ToUpper(m))
+	}
+	if c.Path != "" {
+		if r.Path, err = regexp.Compile(c.Path); err != nil {
+			return Route{}, fmt.Errorf("invalid path regex %v: %w", c.Path, err)
+		}
+	}
+	for name, value := range c.Headers {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return Route{}, fmt.Errorf("invalid regex %v for header %v: %w", value, name, err)
+		}
+		if r.Headers == nil {
+			r.Headers = map[string]*regexp.Regexp{}
+		}
+		r.Headers[name] = re
+	}
+	if c.Mode != "" {
+		if r.Mode, err = ParseMode(c.Mode); err != nil {
+			return Route{}, err
+		}
+	}
+	if r.Mode == ModeConsistentHash && r.HashHeader == "" {
+		return Route{}, fmt.Errorf("consistent-hash mode requires the hashHeader to be set")
+	}
+	if c.SuccessPolicy != "" {
+		if r.SuccessPolicy, err = ParseSuccessPolicy(c.SuccessPolicy); err != nil {
+			return Route{}, err
+		}
+	}
+	if c.Timeout != "" {
+		if r.Timeout, err = time.ParseDuration(c.Timeout); err != nil {
+			return Route{}, fmt.Errorf("invalid timeout %v: %w", c.Timeout, err)
+		}
+	}
+	if r.Auth, err = auth.ParseMethods(c.Auth); err != nil {
+		return Route{}, err
+	}
+	if c.RequestHeaders != nil {
+		if r.RequestHeaders, err = c.RequestHeaders.Rules(); err != nil {
+			return Route{}, fmt.Errorf("invalid request headers: %w", err)
+		}
+	}
+	if c.ResponseHeaders != nil {
+		if r.ResponseHeaders, err = c.ResponseHeaders.Rules(); err != nil {
+			return Route{}, fmt.Errorf("invalid response headers: %w", err)
+		}
+	}
+	if c.Rewrite != nil {
+		if r.Rewrite, err = c.Rewrite.Rewrite(); err != nil {
+			return Route{}, fmt.Errorf("invalid rewrite: %w", err)
+		}
+	}
+	return r, nil
+}
+
+// ServiceRoute converts the service enabled for broadcasting by annotations to a route sending the requests to the backend.
+func ServiceRoute(svc controller.BroadcastService, backend string) (Route, error) {
+	rule := RuleConfig{
+		Host:          svc.Host,
+		Mode:          svc.Mode,
+		HashHeader:    svc.HashHeader,
+		SuccessPolicy: svc.SuccessPolicy,
+	}
+	r, err := rule.Route()
+	if err != nil {
+		return Route{}, err
+	}
+	r.PathPrefix = svc.PathPrefix
+	r.Timeout = svc.Timeout
+	r.Objects = []auth.Object{{Namespace: svc.Namespace, Name: svc.Name}}
+	r.Backend = backend
+	return r, nil
+}
+
+// RouteFromSpec converts spec of the BroadcastRoute to a route sending the requests to the backend.
+func RouteFromSpec(spec controller.BroadcastRouteSpec, backend string) (Route, error) {
+	if len(spec.Services) == 0 {
+		return Route{}, fmt.Errorf("at least one service has to be specified")
+	}
+	rule := RuleConfig{
+		Host:          spec.Match.Host,
+		Methods:       spec.Match.Methods,
+		Path:          spec.Match.Path,
+		Headers:       spec.Match.Headers,
+		Mode:          spec.Mode,
+		HashHeader:    spec.HashHeader,
+		SuccessPolicy: spec.SuccessPolicy,
+		Timeout:       spec.Timeout,
+		Retries:       spec.Retries,
+	}
+	r, err := rule.Route()
+	if err != nil {
+		return Route{}, err
+	}
+	r.PathPrefix = spec.Match.PathPrefix
+	r.Backend = backend
+	return r, nil
+}
+
+// LoadRulesFile loads routes from the YAML or JSON rules file.
+func LoadRulesFile(path string) ([]Route, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config RulesConfig
+	if err := yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse rules file %v: %w", path, err)
+	}
+	var routes []Route
+	for i, rule := range config.Rules {
+		route, err := rule.Route()
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule number %d in %v: %w", i+1, path, err)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler
+
+import (
+	"context"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// TargetResult is result of the request sent to single target.
+type TargetResult struct {
+	Target     controller.Target
+	StatusCode int
+	Body       []byte
+	Duration   time.Duration
+}
+
+// Failed returns true if the request failed.
+func (r TargetResult) Failed() bool {
+	return r.StatusCode >= 400
+}
+
+// Broadcast sends the request to all the targets in parallel and returns results of all of them in order of the targets.
+// Unlike serving the requests, it waits for all the targets regardless of the success policy.
+// Timeout and retries of the route matching the request apply the same way as when serving it.
+func (h *multiplexingHandler) Broadcast(ctx context.Context, req *http.Request, targets []controller.Target) []TargetResult {
+	route := h.matchRoute(req)
+	ctx, cancelFunc := context.WithTimeout(ctx, route.Timeout)
+	defer cancelFunc()
+	reqLog := log.WithField("path", req.URL.Path)
+	results := make([]TargetResult, len(targets))
+	wg := sync.WaitGroup{}
+	for i, target := range targets {
+		i, target := i, target
+		results[i].Target = target
+		duplicate, err := h.targetRequest(ctx, req, route, target, i)
+		if err != nil {
+			results[i].StatusCode = http.StatusInternalServerError
+			results[i].Body = []byte(err.Error())
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			resp := h.handleRequestWithRetries(target, duplicate, route.Retries, reqLog)
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				body = []byte(err.Error())
+			}
+			results[i].StatusCode = resp.StatusCode
+			results[i].Body = body
+			results[i].Duration = time.Since(start)
+		}()
+	}
+	wg.Wait()
+	return results
+}
@@ -40,13 +40,16 @@ func duplicateRequest(request *http.Request) (dup *http.Request) {
 	}
 	request.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
 	dup = &http.Request{
-		Method:        request.Method,
-		URL:           request.URL,
-		Proto:         request.Proto,
-		ProtoMajor:    request.ProtoMajor,
-		ProtoMinor:    request.ProtoMinor,
-		Header:        request.Header,
-		Body:          ioutil.NopCloser(bytes.NewBuffer(bodyBytes)),
+		Method:     request.Method,
+		URL:        request.URL,
+		Proto:      request.Proto,
+		ProtoMajor: request.ProtoMajor,
+		ProtoMinor: request.ProtoMinor,
+		Header:     request.Header.Clone(),
+		Body:       ioutil.NopCloser(bytes.NewBuffer(bodyBytes)),
+		GetBody: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(bodyBytes)), nil
+		},
 		Host:          request.Host,
 		ContentLength: request.ContentLength,
 		Close:         true,
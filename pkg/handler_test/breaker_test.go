@@ -0,0 +1,208 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler_test
+
+import (
+	"github.com/fusakla/k8s-service-broadcasting/pkg/handler"
+	"github.com/magiconair/properties/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMultiplexingHandler_CircuitBreaker(t *testing.T) {
+	var (
+		failing  = true
+		hits     = 0
+		stateMtx sync.Mutex
+	)
+	flakyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stateMtx.Lock()
+		defer stateMtx.Unlock()
+		hits++
+		if failing {
+			http.Error(w, "fail", http.StatusInternalServerError)
+		}
+	}))
+	defer flakyServer.Close()
+	okServer := newCountingServer()
+	defer okServer.server.Close()
+
+	multiplexingHandler := handler.NewMultiplexingHandler("", time.Second, true, false)
+	multiplexingHandler.SetCircuitBreaker(handler.BreakerConfig{FailureThreshold: 2, OpenDuration: 200 * time.Millisecond})
+	multiplexingHandler.SetTargetAddresses([]string{getServerURL(flakyServer.URL), getServerURL(okServer.server.URL)})
+	testedServer := httptest.NewServer(multiplexingHandler)
+	defer testedServer.Close()
+
+	get := func() *http.Response {
+		resp, err := http.Get(testedServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	hitsOfFlaky := func() int {
+		stateMtx.Lock()
+		defer stateMtx.Unlock()
+		return hits
+	}
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, get().StatusCode, http.StatusInternalServerError)
+	}
+	// After two failures the circuit opens and the flaky target is short-circuited.
+	for i := 0; i < 2; i++ {
+		resp := get()
+		assert.Equal(t, resp.StatusCode, http.StatusServiceUnavailable)
+		assert.Equal(t, resp.Header.Get("X-Circuit-Breaker"), "open")
+	}
+	assert.Equal(t, hitsOfFlaky(), 2)
+	assert.Equal(t, okServer.hits(), 4)
+
+	stateMtx.Lock()
+	failing = false
+	stateMtx.Unlock()
+	time.Sleep(300 * time.Millisecond)
+
+	// Probe request succeeds and closes the circuit.
+	assert.Equal(t, get().StatusCode, http.StatusOK)
+	assert.Equal(t, get().StatusCode, http.StatusOK)
+	assert.Equal(t, hitsOfFlaky(), 4)
+}
+
+type probedServer struct {
+	server *httptest.Server
+	mode   string
+	count  int
+	mtx    sync.Mutex
+}
+
+// newProbedServer returns server which fails, hangs until the request is cancelled or succeeds depending on its mode.
+func newProbedServer() *probedServer {
+	p := &probedServer{mode: "fail"}
+	p.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mtx.Lock()
+		p.count++
+		mode := p.mode
+		p.mtx.Unlock()
+		switch mode {
+		case "fail":
+			http.Error(w, "fail", http.StatusInternalServerError)
+		case "hang":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}))
+	return p
+}
+
+func (p *probedServer) setMode(mode string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.mode = mode
+}
+
+func (p *probedServer) hits() int {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.count
+}
+
+func TestMultiplexingHandler_CircuitBreakerProbeTimeout(t *testing.T) {
+	probed := newProbedServer()
+	defer probed.server.Close()
+
+	multiplexingHandler := handler.NewMultiplexingHandler("", 100*time.Millisecond, true, false)
+	multiplexingHandler.SetCircuitBreaker(handler.BreakerConfig{FailureThreshold: 2, OpenDuration: 100 * time.Millisecond})
+	multiplexingHandler.SetTargetAddresses([]string{getServerURL(probed.server.URL)})
+	testedServer := httptest.NewServer(multiplexingHandler)
+	defer testedServer.Close()
+
+	get := func() int {
+		resp, err := http.Get(testedServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, get(), http.StatusInternalServerError)
+	assert.Equal(t, get(), http.StatusInternalServerError)
+	assert.Equal(t, get(), http.StatusServiceUnavailable)
+
+	// The probe times out, which opens the circuit again.
+	probed.setMode("hang")
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, get(), http.StatusGatewayTimeout)
+	assert.Equal(t, get(), http.StatusServiceUnavailable)
+
+	// Next probe is let through after the open duration.
+	probed.setMode("ok")
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, get(), http.StatusOK)
+	assert.Equal(t, probed.hits(), 4)
+}
+
+func TestMultiplexingHandler_CircuitBreakerProbeCancelled(t *testing.T) {
+	probed := newProbedServer()
+	defer probed.server.Close()
+	okServer := newCountingServer()
+	defer okServer.server.Close()
+
+	multiplexingHandler := handler.NewMultiplexingHandler("", time.Second, true, false)
+	multiplexingHandler.SetCircuitBreaker(handler.BreakerConfig{FailureThreshold: 2, OpenDuration: 100 * time.Millisecond})
+	multiplexingHandler.SetHedging(20*time.Millisecond, 0)
+	multiplexingHandler.SetTargetAddresses([]string{getServerURL(probed.server.URL), getServerURL(okServer.server.URL)})
+	testedServer := httptest.NewServer(multiplexingHandler)
+	defer testedServer.Close()
+
+	get := func() int {
+		resp, err := http.Get(testedServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	// getUntilProbed sends hedged requests until one of them reaches the probed server.
+	getUntilProbed := func() bool {
+		hits := probed.hits()
+		for i := 0; i < 50; i++ {
+			assert.Equal(t, get(), http.StatusOK)
+			if probed.hits() > hits {
+				return true
+			}
+		}
+		return false
+	}
+
+	assert.Equal(t, get(), http.StatusInternalServerError)
+	assert.Equal(t, get(), http.StatusInternalServerError)
+
+	// The hanging probe is cancelled once the other target wins the hedged request.
+	probed.setMode("hang")
+	multiplexingHandler.SetMode(handler.ModeHedged)
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, getUntilProbed(), true)
+
+	// Cancelled probe does not block the following ones.
+	probed.setMode("ok")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, getUntilProbed(), true)
+}
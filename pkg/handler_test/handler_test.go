@@ -14,7 +14,10 @@
 package handler_test
 
 import (
+	"context"
 	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/auth"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
 	"github.com/fusakla/k8s-service-broadcasting/pkg/handler"
 	"github.com/magiconair/properties/assert"
 	log "github.com/sirupsen/logrus"
@@ -22,6 +25,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -100,3 +104,458 @@ func TestMultiplexingHandler_ServeHTTP(t *testing.T) {
 	}
 
 }
+
+func TestMultiplexingHandler_ServeHTTPHedged(t *testing.T) {
+	var (
+		okServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = fmt.Fprintln(w, "OK", http.StatusOK)
+		}))
+		slowServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-time.After(5 * time.Second):
+			case <-r.Context().Done():
+			}
+		}))
+		errServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "fail", http.StatusServiceUnavailable)
+		}))
+		okServerURL   = getServerURL(okServer.URL)
+		slowServerURL = getServerURL(slowServer.URL)
+		errServerURL  = getServerURL(errServer.URL)
+
+		testCases = []testCase{
+			{addresses: []string{}, timeout: time.Second, response: http.StatusServiceUnavailable},
+			{addresses: []string{okServerURL}, timeout: time.Second, response: http.StatusOK},
+			{addresses: []string{slowServerURL, okServerURL}, timeout: time.Second, response: http.StatusOK},
+			{addresses: []string{errServerURL, okServerURL}, timeout: time.Second, response: http.StatusOK},
+			{addresses: []string{errServerURL, errServerURL}, timeout: time.Second, response: http.StatusServiceUnavailable},
+			{addresses: []string{slowServerURL}, timeout: 200 * time.Millisecond, response: http.StatusGatewayTimeout},
+		}
+	)
+	defer okServer.Close()
+	defer slowServer.Close()
+	defer errServer.Close()
+
+	for _, testCase := range testCases {
+		multiplexingHandler := handler.NewMultiplexingHandler("", testCase.timeout, testCase.allMustSucceed, testCase.keepalive)
+		multiplexingHandler.SetMode(handler.ModeHedged)
+		multiplexingHandler.SetHedging(50*time.Millisecond, 0)
+		testedServer := httptest.NewServer(multiplexingHandler)
+		multiplexingHandler.SetTargetAddresses(testCase.addresses)
+		response, err := http.Get(testedServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testedServer.Close()
+		assert.Equal(t, response.StatusCode, testCase.response, fmt.Sprintf("hosts: %v", testCase.addresses))
+	}
+}
+
+func TestMultiplexingHandler_NotReadyBestEffort(t *testing.T) {
+	okServer := newCountingServer()
+	defer okServer.server.Close()
+	errServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "fail", http.StatusServiceUnavailable)
+	}))
+	defer errServer.Close()
+	targets := []controller.Target{
+		{Address: getServerURL(okServer.server.URL), Ready: true},
+		{Address: getServerURL(errServer.URL), Ready: false},
+	}
+
+	for _, bestEffort := range []bool{false, true} {
+		multiplexingHandler := handler.NewMultiplexingHandler("", 10*time.Second, true, false)
+		multiplexingHandler.SetNotReadyBestEffort(bestEffort)
+		multiplexingHandler.SetTargets(targets)
+		testedServer := httptest.NewServer(multiplexingHandler)
+		response, err := http.Get(testedServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testedServer.Close()
+		expected := http.StatusServiceUnavailable
+		if bestEffort {
+			expected = http.StatusOK
+		}
+		assert.Equal(t, response.StatusCode, expected)
+	}
+	assert.Equal(t, okServer.hits(), 2)
+}
+
+func TestMultiplexingHandler_OnePerClusterPolicy(t *testing.T) {
+	okServer := newCountingServer()
+	defer okServer.server.Close()
+	errServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "fail", http.StatusServiceUnavailable)
+	}))
+	defer errServer.Close()
+	ok, fail := getServerURL(okServer.server.URL), getServerURL(errServer.URL)
+
+	for _, testCase := range []struct {
+		clusters []string
+		targets  []controller.Target
+		response int
+	}{
+		{
+			targets:  []controller.Target{{Address: ok, Cluster: "a", Ready: true}, {Address: fail, Cluster: "a", Ready: true}, {Address: fail, Cluster: "b", Ready: true}},
+			response: http.StatusServiceUnavailable,
+		},
+		{
+			targets:  []controller.Target{{Address: ok, Cluster: "a", Ready: true}, {Address: fail, Cluster: "b", Ready: true}, {Address: ok, Cluster: "b", Ready: true}},
+			response: http.StatusOK,
+		},
+		{
+			// Cluster b has no targets, so the request did not reach it.
+			clusters: []string{"a", "b"},
+			targets:  []controller.Target{{Address: ok, Cluster: "a", Ready: true}},
+			response: http.StatusServiceUnavailable,
+		},
+		{
+			clusters: []string{"a", "b"},
+			targets:  []controller.Target{{Address: ok, Cluster: "a", Ready: true}, {Address: ok, Cluster: "b", Ready: true}},
+			response: http.StatusOK,
+		},
+	} {
+		multiplexingHandler := handler.NewMultiplexingHandler("", 10*time.Second, true, false)
+		multiplexingHandler.SetSuccessPolicy(handler.PolicyOnePerCluster)
+		multiplexingHandler.SetClusters(testCase.clusters)
+		multiplexingHandler.SetTargets(testCase.targets)
+		testedServer := httptest.NewServer(multiplexingHandler)
+		response, err := http.Get(testedServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testedServer.Close()
+		assert.Equal(t, response.StatusCode, testCase.response)
+	}
+}
+
+func TestMultiplexingHandler_Zones(t *testing.T) {
+	okServer := newCountingServer()
+	defer okServer.server.Close()
+	errServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "fail", http.StatusServiceUnavailable)
+	}))
+	defer errServer.Close()
+	ok, fail := getServerURL(okServer.server.URL), getServerURL(errServer.URL)
+
+	for _, testCase := range []struct {
+		localZone string
+		targets   []controller.Target
+		response  int
+	}{
+		{
+			targets:  []controller.Target{{Address: ok, Zone: "a", Ready: true}, {Address: fail, Zone: "b", Ready: true}},
+			response: http.StatusServiceUnavailable,
+		},
+		{
+			targets:  []controller.Target{{Address: ok, Zone: "a", Ready: true}, {Address: fail, Zone: "b", Ready: true}, {Address: ok, Zone: "b", Ready: true}},
+			response: http.StatusOK,
+		},
+		{
+			localZone: "a",
+			targets:   []controller.Target{{Address: ok, Zone: "a", Ready: true}, {Address: fail, Zone: "b", Ready: true}},
+			response:  http.StatusOK,
+		},
+		{
+			localZone: "c",
+			targets:   []controller.Target{{Address: ok, Zone: "a", Ready: true}, {Address: fail, Zone: "b", Ready: true}},
+			response:  http.StatusServiceUnavailable,
+		},
+	} {
+		multiplexingHandler := handler.NewMultiplexingHandler("", 10*time.Second, true, false)
+		multiplexingHandler.SetSuccessPolicy(handler.PolicyOnePerZone)
+		multiplexingHandler.SetLocalZone(testCase.localZone)
+		multiplexingHandler.SetTargets(testCase.targets)
+		testedServer := httptest.NewServer(multiplexingHandler)
+		response, err := http.Get(testedServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testedServer.Close()
+		assert.Equal(t, response.StatusCode, testCase.response)
+	}
+}
+
+func TestMultiplexingHandler_Broadcast(t *testing.T) {
+	okServer := newCountingServer()
+	defer okServer.server.Close()
+	errServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "fail", http.StatusServiceUnavailable)
+	}))
+	defer errServer.Close()
+
+	targets := []controller.Target{
+		{Address: getServerURL(okServer.server.URL), Zone: "a", Ready: true},
+		{Address: getServerURL(errServer.URL), Zone: "b", Ready: true},
+		{Address: getServerURL(okServer.server.URL), Zone: "b", Ready: true},
+	}
+	multiplexingHandler := handler.NewMultiplexingHandler("", 10*time.Second, true, false)
+	req, _ := http.NewRequest(http.MethodDelete, "/metrics/job/test", nil)
+	results := multiplexingHandler.Broadcast(context.Background(), req, targets)
+	assert.Equal(t, len(results), 3)
+	assert.Equal(t, results[1].Target, targets[1])
+	assert.Equal(t, results[1].StatusCode, http.StatusServiceUnavailable)
+	assert.Equal(t, string(results[1].Body), "fail\n")
+	assert.Equal(t, okServer.hits(), 2)
+
+	assert.Equal(t, handler.PolicyAll.Succeeded(results, nil), false)
+	assert.Equal(t, handler.PolicyAny.Succeeded(results, nil), true)
+	assert.Equal(t, handler.PolicyOnePerZone.Succeeded(results, nil), true)
+	assert.Equal(t, handler.PolicyOnePerZone.Succeeded(results[1:2], nil), false)
+	assert.Equal(t, handler.PolicyOnePerCluster.Succeeded(results, nil), true)
+	// Target without zone neither forms a zone nor satisfies one.
+	unknownZone := []handler.TargetResult{{Target: controller.Target{Zone: "a"}, StatusCode: http.StatusOK}, {Target: controller.Target{}, StatusCode: http.StatusInternalServerError}}
+	assert.Equal(t, handler.PolicyOnePerZone.Succeeded(unknownZone, nil), true)
+	assert.Equal(t, handler.PolicyOnePerZone.Succeeded([]handler.TargetResult{unknownZone[1], {Target: controller.Target{Zone: "a"}, StatusCode: http.StatusInternalServerError}}, nil), false)
+	assert.Equal(t, handler.PolicyOnePerCluster.Succeeded(results, []string{"", "eu"}), false)
+	assert.Equal(t, handler.PolicyAny.Succeeded(nil, nil), false)
+}
+
+func TestMultiplexingHandler_BroadcastRoute(t *testing.T) {
+	var (
+		failures = 2
+		mtx      sync.Mutex
+	)
+	flakyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		if failures > 0 {
+			failures--
+			http.Error(w, "fail", http.StatusInternalServerError)
+		}
+	}))
+	defer flakyServer.Close()
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer slowServer.Close()
+
+	route, err := handler.RuleConfig{Path: "^/metrics/", Timeout: "200ms", Retries: 2}.Route()
+	assert.Equal(t, err, nil)
+	multiplexingHandler := handler.NewMultiplexingHandler("", 10*time.Second, true, false)
+	multiplexingHandler.SetRoutes([]handler.Route{route})
+	targets := []controller.Target{
+		{Address: getServerURL(flakyServer.URL), Ready: true},
+		{Address: getServerURL(slowServer.URL), Ready: true},
+	}
+	req, _ := http.NewRequest(http.MethodPut, "/metrics/job/test", strings.NewReader("metric 1\n"))
+	start := time.Now()
+	results := multiplexingHandler.Broadcast(context.Background(), req, targets)
+	assert.Equal(t, time.Since(start) < time.Second, true, "timeout of the route applies")
+	assert.Equal(t, results[0].StatusCode, http.StatusOK, "failed request is retried")
+	assert.Equal(t, results[1].Failed(), true)
+}
+
+func TestParseSuccessPolicy(t *testing.T) {
+	policy, err := handler.ParseSuccessPolicy("one-per-zone")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, policy, handler.PolicyOnePerZone)
+
+	_, err = handler.ParseSuccessPolicy("most")
+	assert.Equal(t, err.Error(), "unknown success policy most, supported policies are: all, any, one-per-cluster, one-per-zone")
+}
+
+type staticCredentials string
+
+func (c staticCredentials) Apply(req *http.Request) {
+	req.Header.Set("Authorization", "Bearer "+string(c))
+}
+
+func TestMultiplexingHandler_BackendCredentials(t *testing.T) {
+	authorizations := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorizations <- r.Header.Get("Authorization")
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		credentials auth.Credentials
+		strip       bool
+		expected    string
+	}{
+		{expected: "Bearer client"},
+		{strip: true, expected: ""},
+		{credentials: staticCredentials("backend"), expected: "Bearer backend"},
+		{credentials: staticCredentials("backend"), strip: true, expected: "Bearer backend"},
+	}
+	for _, testCase := range testCases {
+		multiplexingHandler := handler.NewMultiplexingHandler("", time.Second, true, false)
+		multiplexingHandler.SetTargetAddresses([]string{getServerURL(server.URL), getServerURL(server.URL)})
+		multiplexingHandler.SetBackendCredentials(testCase.credentials, testCase.strip)
+
+		req := httptest.NewRequest(http.MethodPost, "/metrics", nil)
+		req.Header.Set("Authorization", "Bearer client")
+		w := httptest.NewRecorder()
+		multiplexingHandler.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, http.StatusOK)
+		for i := 0; i < 2; i++ {
+			assert.Equal(t, <-authorizations, testCase.expected)
+		}
+		assert.Equal(t, req.Header.Get("Authorization"), "Bearer client", "header of the client request must not be changed")
+	}
+}
+
+func TestMultiplexingHandler_Headers(t *testing.T) {
+	headers := make(chan http.Header, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+		w.Header().Set("X-Backend-Secret", "internal")
+		w.Header().Set("Keep-Alive", "timeout=5")
+	}))
+	defer server.Close()
+	target := getServerURL(server.URL)
+
+	var requestConfig, responseConfig handler.HeaderRulesConfig
+	for _, rule := range []string{"set:X-Target={{ .Target.Address }}", "add:X-Pod={{ .Target.Pod }}", "remove:X-Debug"} {
+		assert.Equal(t, requestConfig.ParseRule(rule), nil)
+	}
+	for _, rule := range []string{"remove:X-Backend-Secret", "set:X-Served-By={{ .Target.Pod }}"} {
+		assert.Equal(t, responseConfig.ParseRule(rule), nil)
+	}
+	requestRules, err := requestConfig.Rules()
+	assert.Equal(t, err, nil)
+	responseRules, err := responseConfig.Rules()
+	assert.Equal(t, err, nil)
+	for _, invalid := range []string{"set:X-Target", "rename:X-A=X-B", "remove:"} {
+		if err := (&handler.HeaderRulesConfig{}).ParseRule(invalid); err == nil {
+			t.Errorf("expected error for header rule %v", invalid)
+		}
+	}
+	if _, err := (handler.HeaderRulesConfig{Set: map[string]string{"X-Target": "{{ .Target"}}).Rules(); err == nil {
+		t.Error("expected error for invalid template")
+	}
+
+	multiplexingHandler := handler.NewMultiplexingHandler("", time.Second, true, false)
+	multiplexingHandler.SetTargets([]controller.Target{{Address: target, Pod: "app-0", Ready: true}, {Address: target, Pod: "app-1", Ready: true}})
+	multiplexingHandler.SetHeaderRules(requestRules, responseRules)
+
+	req := httptest.NewRequest(http.MethodPost, "/metrics", nil)
+	req.Host = "broadcaster"
+	req.RemoteAddr = "10.0.0.2:4321"
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Proxy-Authorization", "Basic secret")
+	req.Header.Set("X-Debug", "true")
+	w := httptest.NewRecorder()
+	multiplexingHandler.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, http.StatusOK)
+
+	var pods []string
+	for i := 0; i < 2; i++ {
+		h := <-headers
+		for _, name := range []string{"X-Hop", "Proxy-Authorization", "X-Debug"} {
+			assert.Equal(t, h.Get(name), "", name)
+		}
+		assert.Equal(t, h.Get("X-Forwarded-For"), "10.0.0.1, 10.0.0.2")
+		assert.Equal(t, h.Get("X-Forwarded-Proto"), "http")
+		assert.Equal(t, h.Get("X-Forwarded-Host"), "broadcaster")
+		assert.Equal(t, h.Get("Forwarded"), `for=10.0.0.2;proto=http;host="broadcaster"`)
+		assert.Equal(t, h.Get("X-Target"), target)
+		assert.Equal(t, len(h["X-Pod"]), 1, "header must not be shared between the targets")
+		pods = append(pods, h.Get("X-Pod"))
+	}
+	if !(pods[0] == "app-0" && pods[1] == "app-1") && !(pods[0] == "app-1" && pods[1] == "app-0") {
+		t.Errorf("expected pod of each target, got %v", pods)
+	}
+	assert.Equal(t, req.Header.Get("X-Debug"), "true", "header of the client request must not be changed")
+	assert.Equal(t, w.Header().Get("X-Backend-Secret"), "")
+	assert.Equal(t, w.Header().Get("Keep-Alive"), "")
+	if servedBy := w.Header().Get("X-Served-By"); servedBy != "app-0" && servedBy != "app-1" {
+		t.Errorf("expected pod of the target in the response header, got %q", servedBy)
+	}
+
+	multiplexingHandler.SetForwardedHeaders(handler.ForwardedReplace)
+	w = httptest.NewRecorder()
+	multiplexingHandler.ServeHTTP(w, req)
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, (<-headers).Get("X-Forwarded-For"), "10.0.0.2")
+	}
+}
+
+func TestMultiplexingHandler_Rewrite(t *testing.T) {
+	requests := make(chan string, 10)
+	var targets []string
+	for i := 0; i < 3; i++ {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests <- r.URL.RequestURI() + " " + r.Header.Get("X-Index")
+		}))
+		defer server.Close()
+		targets = append(targets, getServerURL(server.URL))
+	}
+
+	route, err := handler.RuleConfig{
+		Path:    "^/api/",
+		Rewrite: &handler.RewriteConfig{Path: "{{ .Request.URL.Path }}/{{ .Ordinal }}", Query: map[string]string{"replica": "{{ .Target.Pod }}"}},
+	}.Route()
+	assert.Equal(t, err, nil)
+	var headersConfig handler.HeaderRulesConfig
+	assert.Equal(t, headersConfig.ParseRule("set:X-Index={{ .Index }}"), nil)
+	headerRules, err := headersConfig.Rules()
+	assert.Equal(t, err, nil)
+	var rewriteConfig handler.RewriteConfig
+	assert.Equal(t, rewriteConfig.ParseQuery("node={{ .Target.Node }}"), nil)
+	rewrite, err := rewriteConfig.Rewrite()
+	assert.Equal(t, err, nil)
+	if err := rewriteConfig.ParseQuery("{{ .Target.Pod }}"); err == nil {
+		t.Error("expected error for query parameter without name")
+	}
+	if _, err := (handler.RewriteConfig{Path: "{{ .Ordinal"}).Rewrite(); err == nil {
+		t.Error("expected error for invalid template")
+	}
+
+	multiplexingHandler := handler.NewMultiplexingHandler("", time.Second, true, false)
+	multiplexingHandler.SetRoutes([]handler.Route{route})
+	multiplexingHandler.SetHeaderRules(headerRules, nil)
+	multiplexingHandler.SetRewrite(rewrite)
+	multiplexingHandler.SetTargets([]controller.Target{
+		{Address: targets[0], Pod: "pushgateway-0", Node: "node-a", Ready: true},
+		{Address: targets[1], Pod: "pushgateway-1", Node: "node-b", Ready: true},
+		{Address: targets[2], Pod: "app-7d9f8-x2v", Node: "node-c", Ready: true},
+	})
+
+	testCases := []struct {
+		path     string
+		expected []string
+	}{
+		{path: "/api/metrics?job=test", expected: []string{
+			"/api/metrics/0?job=test&node=node-a&replica=pushgateway-0 0",
+			"/api/metrics/1?job=test&node=node-b&replica=pushgateway-1 1",
+			"/api/metrics/-1?job=test&node=node-c&replica=app-7d9f8-x2v 2",
+		}},
+		{path: "/metrics", expected: []string{
+			"/metrics?node=node-a 0",
+			"/metrics?node=node-b 1",
+			"/metrics?node=node-c 2",
+		}},
+	}
+	for _, testCase := range testCases {
+		w := httptest.NewRecorder()
+		multiplexingHandler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, testCase.path, nil))
+		assert.Equal(t, w.Code, http.StatusOK)
+		received := map[string]bool{}
+		for range testCase.expected {
+			received[<-requests] = true
+		}
+		for _, expected := range testCase.expected {
+			assert.Equal(t, received[expected], true, expected)
+		}
+	}
+
+	// Index of the target is the same when only some of the targets are used.
+	multiplexingHandler.SetMode(handler.ModeRoundRobin)
+	multiplexingHandler.SetTargets([]controller.Target{
+		{Address: targets[0], Pod: "pushgateway-0", Node: "node-a", Ready: false},
+		{Address: targets[1], Pod: "pushgateway-1", Node: "node-b", Ready: true},
+	})
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		multiplexingHandler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+		assert.Equal(t, w.Code, http.StatusOK)
+		assert.Equal(t, <-requests, "/metrics?node=node-b 1")
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler_test
+
+import (
+	"github.com/fusakla/k8s-service-broadcasting/pkg/handler"
+	"github.com/magiconair/properties/assert"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimitingHandler_RateLimit(t *testing.T) {
+	for _, config := range []handler.LimitsConfig{
+		{Rate: 1, Burst: 2},
+		{ClientRate: 1, ClientBurst: 2},
+	} {
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		testedServer := httptest.NewServer(handler.NewLimitingHandler(next, config))
+		var statuses []int
+		for i := 0; i < 3; i++ {
+			resp, err := http.Get(testedServer.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			statuses = append(statuses, resp.StatusCode)
+		}
+		testedServer.Close()
+		assert.Equal(t, statuses, []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests})
+	}
+}
+
+func TestLimitingHandler_MaxInFlight(t *testing.T) {
+	for _, testCase := range []struct {
+		queueTimeout time.Duration
+		response     int
+	}{
+		{queueTimeout: 0, response: http.StatusServiceUnavailable},
+		{queueTimeout: 5 * time.Second, response: http.StatusOK},
+	} {
+		release := make(chan struct{})
+		started := make(chan struct{}, 1)
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+		})
+		testedServer := httptest.NewServer(handler.NewLimitingHandler(next, handler.LimitsConfig{MaxInFlight: 1, QueueTimeout: testCase.queueTimeout}))
+		go func() {
+			resp, err := http.Get(testedServer.URL)
+			if err == nil {
+				_ = resp.Body.Close()
+			}
+		}()
+		<-started
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			close(release)
+		}()
+		resp, err := http.Get(testedServer.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, resp.StatusCode, testCase.response)
+		testedServer.Close()
+	}
+}
+
+// queuedRequests returns value of the requests_queued gauge.
+func queuedRequests(t *testing.T) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() == "requests_queued" {
+			return f.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatal("requests_queued metric not found")
+	return 0
+}
+
+func TestLimitingHandler_Queued(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	testedServer := httptest.NewServer(handler.NewLimitingHandler(next, handler.LimitsConfig{Rate: 100, MaxInFlight: 1, QueueTimeout: 5 * time.Second}))
+	defer testedServer.Close()
+	done := make(chan int, 2)
+	get := func() {
+		resp, err := http.Get(testedServer.URL)
+		if err != nil {
+			done <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		done <- resp.StatusCode
+	}
+	// Request passing the limits right away is not queued.
+	go get()
+	<-started
+	assert.Equal(t, queuedRequests(t), float64(0))
+
+	go get()
+	deadline := time.Now().Add(5 * time.Second)
+	for queuedRequests(t) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("request waiting for the in flight limit is not queued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	assert.Equal(t, <-done, http.StatusOK)
+	assert.Equal(t, <-done, http.StatusOK)
+	assert.Equal(t, queuedRequests(t), float64(0))
+}
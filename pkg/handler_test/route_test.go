@@ -0,0 +1,391 @@
+// Copyright 2019 FUSAKLA Martin Chodúr
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package handler_test
+
+import (
+	"fmt"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/auth"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/controller"
+	"github.com/fusakla/k8s-service-broadcasting/pkg/handler"
+	"github.com/magiconair/properties/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type countingServer struct {
+	server *httptest.Server
+	count  int
+	mtx    sync.Mutex
+}
+
+func newCountingServer() *countingServer {
+	c := &countingServer{}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.mtx.Lock()
+		c.count++
+		c.mtx.Unlock()
+	}))
+	return c
+}
+
+func (c *countingServer) hits() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.count
+}
+
+func TestParseRoute(t *testing.T) {
+	route, err := handler.ParseRoute("/api/v1/metrics=consistent-hash:X-Tenant")
+	assert.Equal(t, err, nil)
+	assert.Equal(t, route, handler.Route{PathPrefix: "/api/v1/metrics", Mode: handler.ModeConsistentHash, HashHeader: "X-Tenant"})
+
+	for _, invalid := range []string{"/foo", "=broadcast", "/foo=unknown", "/foo=consistent-hash"} {
+		if _, err := handler.ParseRoute(invalid); err == nil {
+			t.Errorf("expected error for route %v", invalid)
+		}
+	}
+}
+
+func TestMultiplexingHandler_Routes(t *testing.T) {
+	first, second := newCountingServer(), newCountingServer()
+	defer first.server.Close()
+	defer second.server.Close()
+
+	multiplexingHandler := handler.NewMultiplexingHandler("", time.Second, true, false)
+	multiplexingHandler.SetRoutes([]handler.Route{
+		{PathPrefix: "/read", Mode: handler.ModeRoundRobin},
+		{PathPrefix: "/hashed", Mode: handler.ModeConsistentHash, HashHeader: "X-Tenant"},
+	})
+	multiplexingHandler.SetTargetAddresses([]string{getServerURL(first.server.URL), getServerURL(second.server.URL)})
+	testedServer := httptest.NewServer(multiplexingHandler)
+	defer testedServer.Close()
+
+	get := func(path string, tenant string) {
+		req, _ := http.NewRequest(http.MethodGet, testedServer.URL+path, nil)
+		req.Header.Set("X-Tenant", tenant)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, resp.StatusCode, http.StatusOK)
+	}
+
+	// Default mode broadcasts to all targets.
+	get("/write", "")
+	assert.Equal(t, first.hits()+second.hits(), 2)
+
+	for i := 0; i < 4; i++ {
+		get("/read", "")
+	}
+	assert.Equal(t, first.hits(), 3)
+	assert.Equal(t, second.hits(), 3)
+
+	for i := 0; i < 4; i++ {
+		get("/hashed", "tenant-a")
+	}
+	if first.hits() != 7 && second.hits() != 7 {
+		t.Errorf("expected all hashed requests to go to the same target, got %v and %v", first.hits(), second.hits())
+	}
+}
+
+func TestMultiplexingHandler_Rules(t *testing.T) {
+	rulesFile, err := ioutil.TempFile("", "rules*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(rulesFile.Name())
+	_, _ = rulesFile.WriteString(`
+rules:
+  - methods: [delete]
+    mode: reject
+  - methods: [GET]
+    path: ^/api/v1/metrics$
+    mode: round-robin
+  - headers:
+      X-Best-Effort: "true"
+    successPolicy: any
+    timeout: 1s
+`)
+	_ = rulesFile.Close()
+	routes, err := handler.LoadRulesFile(rulesFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	okServer := newCountingServer()
+	defer okServer.server.Close()
+	errServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "fail", http.StatusServiceUnavailable)
+	}))
+	defer errServer.Close()
+
+	multiplexingHandler := handler.NewMultiplexingHandler("", 10*time.Second, true, false)
+	multiplexingHandler.SetRoutes(routes)
+	multiplexingHandler.SetTargetAddresses([]string{getServerURL(okServer.server.URL), getServerURL(errServer.URL)})
+	testedServer := httptest.NewServer(multiplexingHandler)
+	defer testedServer.Close()
+
+	testCases := []struct {
+		method   string
+		path     string
+		header   string
+		response int
+	}{
+		{method: http.MethodDelete, path: "/api/v1/metrics", response: http.StatusForbidden},
+		{method: http.MethodPost, path: "/api/v1/metrics", response: http.StatusServiceUnavailable},
+		{method: http.MethodPost, path: "/api/v1/metrics", header: "true", response: http.StatusOK},
+		// Header value has to match as a whole.
+		{method: http.MethodPost, path: "/api/v1/metrics", header: "untrue", response: http.StatusServiceUnavailable},
+		{method: http.MethodPost, path: "/api/v1/metrics", header: "true-ish", response: http.StatusServiceUnavailable},
+	}
+	for _, testCase := range testCases {
+		req, _ := http.NewRequest(testCase.method, testedServer.URL+testCase.path, nil)
+		req.Header.Set("X-Best-Effort", testCase.header)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, resp.StatusCode, testCase.response, testCase.method, testCase.path)
+	}
+
+	// Round-robin alternates the targets, so only one of two requests hits the ok server.
+	hits := okServer.hits()
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(testedServer.URL + "/api/v1/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+	assert.Equal(t, okServer.hits(), hits+1)
+}
+
+func TestLoadRulesFile_Invalid(t *testing.T) {
+	for _, content := range []string{
+		"rules: [{mode: unknown}]",
+		"rules: [{path: '('}]",
+		"rules: [{timeout: foo}]",
+		"rules: [{successPolicy: some}]",
+		"rules: [{mode: consistent-hash}]",
+		"unknownField: true",
+	} {
+		rulesFile, err := ioutil.TempFile("", "rules*.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = rulesFile.WriteString(content)
+		_ = rulesFile.Close()
+		if _, err := handler.LoadRulesFile(rulesFile.Name()); err == nil {
+			t.Errorf("expected error for rules %v", content)
+		}
+		_ = os.Remove(rulesFile.Name())
+	}
+}
+
+func TestMultiplexingHandler_ServiceRoutes(t *testing.T) {
+	defaultServer, serviceServer := newCountingServer(), newCountingServer()
+	defer defaultServer.server.Close()
+	defer serviceServer.server.Close()
+
+	route, err := handler.ServiceRoute(controller.BroadcastService{Namespace: "monitoring", Name: "pushgateway", Host: "pushgateway.monitoring"}, "pushgateway")
+	assert.Equal(t, err, nil)
+	multiplexingHandler := handler.NewMultiplexingHandler("", time.Second, true, false)
+	multiplexingHandler.SetRoutes([]handler.Route{route})
+	multiplexingHandler.SetTargetAddresses([]string{getServerURL(defaultServer.server.URL)})
+	multiplexingHandler.SetBackendTargets("pushgateway", []controller.Target{{Address: getServerURL(serviceServer.server.URL), Ready: true}})
+	testedServer := httptest.NewServer(multiplexingHandler)
+	defer testedServer.Close()
+
+	get := func(host string) int {
+		req, _ := http.NewRequest(http.MethodGet, testedServer.URL, nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	assert.Equal(t, get("pushgateway.monitoring:8080"), http.StatusOK)
+	assert.Equal(t, get("other"), http.StatusOK)
+	assert.Equal(t, serviceServer.hits(), 1)
+	assert.Equal(t, defaultServer.hits(), 1)
+
+	multiplexingHandler.RemoveBackend("pushgateway")
+	assert.Equal(t, get("pushgateway.monitoring"), http.StatusServiceUnavailable)
+
+	if _, err := handler.ServiceRoute(controller.BroadcastService{SuccessPolicy: "unknown"}, "invalid"); err == nil {
+		t.Error("expected error for invalid success policy")
+	}
+	if _, err := handler.ServiceRoute(controller.BroadcastService{Mode: "unknown"}, "invalid"); err == nil {
+		t.Error("expected error for invalid mode")
+	}
+}
+
+func TestMultiplexingHandler_Retries(t *testing.T) {
+	var mtx sync.Mutex
+	var bodies []string
+	flakyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mtx.Lock()
+		defer mtx.Unlock()
+		bodies = append(bodies, string(body))
+		if len(bodies) < 3 {
+			http.Error(w, "fail", http.StatusServiceUnavailable)
+		}
+	}))
+	defer flakyServer.Close()
+
+	route, err := handler.RouteFromSpec(controller.BroadcastRouteSpec{
+		Match:    controller.BroadcastRouteMatch{PathPrefix: "/push", Methods: []string{"post"}},
+		Services: []controller.BroadcastRouteService{{Name: "pushgateway"}},
+		Retries:  2,
+	}, "pushgateway")
+	assert.Equal(t, err, nil)
+	multiplexingHandler := handler.NewMultiplexingHandler("", time.Second, true, false)
+	multiplexingHandler.SetRoutes([]handler.Route{route})
+	multiplexingHandler.SetBackendTargets("pushgateway", []controller.Target{{Address: getServerURL(flakyServer.URL), Ready: true}})
+	testedServer := httptest.NewServer(multiplexingHandler)
+	defer testedServer.Close()
+
+	resp, err := http.Post(testedServer.URL+"/push", "text/plain", strings.NewReader("metric 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, bodies, []string{"metric 1", "metric 1", "metric 1"})
+
+	if _, err := handler.RouteFromSpec(controller.BroadcastRouteSpec{}, "invalid"); err == nil {
+		t.Error("expected error for route without services")
+	}
+}
+
+type tokenAuthenticator map[string]string
+
+func (a tokenAuthenticator) Authenticate(req *http.Request) (*auth.UserInfo, error) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return nil, nil
+	}
+	if user, ok := a[token]; ok {
+		return &auth.UserInfo{Name: user}, nil
+	}
+	return nil, fmt.Errorf("invalid token")
+}
+
+func TestMultiplexingHandler_Auth(t *testing.T) {
+	okServer := newCountingServer()
+	defer okServer.server.Close()
+
+	public, err := handler.RuleConfig{Path: "^/public", Auth: []string{"none"}}.Route()
+	assert.Equal(t, err, nil)
+	basic, err := handler.RuleConfig{Path: "^/basic", Auth: []string{"basic"}}.Route()
+	assert.Equal(t, err, nil)
+	multiplexingHandler := handler.NewMultiplexingHandler("", time.Second, true, false)
+	multiplexingHandler.SetRoutes([]handler.Route{public, basic})
+	multiplexingHandler.SetAuthentication(map[auth.Method]auth.Authenticator{auth.MethodStaticToken: tokenAuthenticator{"secret": "ci"}}, []auth.Method{auth.MethodStaticToken})
+	multiplexingHandler.SetTargetAddresses([]string{getServerURL(okServer.server.URL)})
+	testedServer := httptest.NewServer(multiplexingHandler)
+	defer testedServer.Close()
+
+	testCases := []struct {
+		path      string
+		token     string
+		response  int
+		challenge string
+	}{
+		{path: "/metrics", token: "secret", response: http.StatusOK},
+		{path: "/metrics", response: http.StatusUnauthorized, challenge: `Bearer realm="k8s-service-broadcasting"`},
+		{path: "/metrics", token: "invalid", response: http.StatusUnauthorized, challenge: `Bearer realm="k8s-service-broadcasting"`},
+		{path: "/public", response: http.StatusOK},
+		{path: "/basic", token: "secret", response: http.StatusUnauthorized, challenge: `Basic realm="k8s-service-broadcasting"`},
+	}
+	for _, testCase := range testCases {
+		hits := okServer.hits()
+		req, _ := http.NewRequest(http.MethodPost, testedServer.URL+testCase.path, nil)
+		if testCase.token != "" {
+			req.Header.Set("Authorization", "Bearer "+testCase.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		assert.Equal(t, resp.StatusCode, testCase.response, testCase.path, testCase.token)
+		assert.Equal(t, resp.Header.Get("WWW-Authenticate"), testCase.challenge, testCase.path, testCase.token)
+		if testCase.response == http.StatusUnauthorized {
+			assert.Equal(t, okServer.hits(), hits, "unauthenticated request must not be broadcasted")
+		}
+	}
+
+	if _, err := (handler.RuleConfig{Auth: []string{"none", "basic"}}).Route(); err == nil {
+		t.Error("expected error for none combined with other methods")
+	}
+}
+
+type userAuthorizer map[string]bool
+
+func (a userAuthorizer) Authorize(user *auth.UserInfo, object auth.Object) (bool, string, error) {
+	if user.Name == "broken" {
+		return false, "", fmt.Errorf("review failed")
+	}
+	return a[user.Name+"@"+object.String()], "not allowed", nil
+}
+
+func TestMultiplexingHandler_Authorization(t *testing.T) {
+	okServer := newCountingServer()
+	defer okServer.server.Close()
+
+	route, err := handler.ServiceRoute(controller.BroadcastService{Namespace: "monitoring", Name: "pushgateway", PathPrefix: "/pushgateway"}, "pushgateway")
+	assert.Equal(t, err, nil)
+	multiplexingHandler := handler.NewMultiplexingHandler("", time.Second, true, false)
+	multiplexingHandler.SetRoutes([]handler.Route{route})
+	multiplexingHandler.SetAuthentication(map[auth.Method]auth.Authenticator{auth.MethodStaticToken: tokenAuthenticator{"ci": "ci", "bob": "bob", "broken": "broken"}}, []auth.Method{auth.MethodStaticToken})
+	multiplexingHandler.SetAuthorization(userAuthorizer{"ci@monitoring/pushgateway": true, "bob@monitoring/prometheus": true}, []auth.Object{{Namespace: "monitoring", Name: "prometheus"}})
+	multiplexingHandler.SetTargetAddresses([]string{getServerURL(okServer.server.URL)})
+	multiplexingHandler.SetBackendTargets("pushgateway", []controller.Target{{Address: getServerURL(okServer.server.URL), Ready: true}})
+	testedServer := httptest.NewServer(multiplexingHandler)
+	defer testedServer.Close()
+
+	testCases := []struct {
+		path     string
+		token    string
+		response int
+	}{
+		{path: "/pushgateway/metrics", token: "ci", response: http.StatusOK},
+		{path: "/pushgateway/metrics", token: "bob", response: http.StatusForbidden},
+		{path: "/metrics", token: "bob", response: http.StatusOK},
+		{path: "/metrics", token: "ci", response: http.StatusForbidden},
+		{path: "/metrics", token: "broken", response: http.StatusServiceUnavailable},
+	}
+	for _, testCase := range testCases {
+		hits := okServer.hits()
+		req, _ := http.NewRequest(http.MethodPost, testedServer.URL+testCase.path, nil)
+		req.Header.Set("Authorization", "Bearer "+testCase.token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		assert.Equal(t, resp.StatusCode, testCase.response, testCase.path, testCase.token)
+		if testCase.response != http.StatusOK {
+			assert.Equal(t, okServer.hits(), hits, "forbidden request must not be broadcasted")
+		}
+	}
+}